@@ -0,0 +1,64 @@
+/*
+Copyright 2021 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package auth
+
+import (
+	"github.com/gravitational/trace"
+
+	"github.com/gravitational/teleport/api/types"
+)
+
+// ApplyServerFilter narrows servers down to those matching filter. It is
+// the push-down primitive backend-cache-backed Presence implementations
+// (GetNodes, GetAppServers, GetKubeServices) call on the raw page of
+// records read from the backend/cache, before any of them are marshaled
+// back to the caller, so non-matching records never leave the server.
+func ApplyServerFilter(servers []types.Server, filter ResourceFilter) ([]types.Server, error) {
+	if filter.IsEmpty() {
+		return servers, nil
+	}
+	out := make([]types.Server, 0, len(servers))
+	for _, s := range servers {
+		match, err := filter.Match(s)
+		if err != nil {
+			return nil, trace.Wrap(err)
+		}
+		if match {
+			out = append(out, s)
+		}
+	}
+	return out, nil
+}
+
+// ApplyDatabaseServerFilter narrows database servers down to those matching
+// filter; see ApplyServerFilter for the rationale.
+func ApplyDatabaseServerFilter(servers []types.DatabaseServer, filter ResourceFilter) ([]types.DatabaseServer, error) {
+	if filter.IsEmpty() {
+		return servers, nil
+	}
+	out := make([]types.DatabaseServer, 0, len(servers))
+	for _, s := range servers {
+		match, err := filter.Match(s)
+		if err != nil {
+			return nil, trace.Wrap(err)
+		}
+		if match {
+			out = append(out, s)
+		}
+	}
+	return out, nil
+}
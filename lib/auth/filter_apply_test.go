@@ -0,0 +1,43 @@
+/*
+Copyright 2021 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package auth
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/gravitational/teleport/api/types"
+)
+
+func TestApplyServerFilter(t *testing.T) {
+	t.Parallel()
+
+	servers := []types.Server{
+		&types.ServerV2{Metadata: types.Metadata{Name: "prod-1", Labels: map[string]string{"env": "prod"}}},
+		&types.ServerV2{Metadata: types.Metadata{Name: "staging-1", Labels: map[string]string{"env": "staging"}}},
+	}
+
+	out, err := ApplyServerFilter(servers, ResourceFilter{Labels: map[string]string{"env": "prod"}})
+	require.NoError(t, err)
+	require.Len(t, out, 1)
+	require.Equal(t, "prod-1", out[0].GetName())
+
+	out, err = ApplyServerFilter(servers, ResourceFilter{})
+	require.NoError(t, err)
+	require.Len(t, out, 2)
+}
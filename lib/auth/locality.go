@@ -0,0 +1,362 @@
+/*
+Copyright 2021 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package auth
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gravitational/trace"
+
+	"github.com/gravitational/teleport/api/types"
+)
+
+// Locality describes where a node, proxy or reverse tunnel is running.
+//
+// The natural home for this is a field on types.ServerV2 and
+// types.ReverseTunnel themselves, set by UpsertNode/UpsertAuthServer/
+// UpsertProxy and carried over the wire like any other server attribute —
+// that needs an api/types schema change this package can't make on its own.
+// Until it lands, Locality rides along as labels on the resources it
+// describes (see the localityLabel* keys, stampLocality and ServerLocality
+// below) and LocalityAwarePresence is what actually stamps it on upsert, so
+// the feature is reachable end-to-end rather than inert.
+type Locality struct {
+	// Region is the broadest locality scope, e.g. a cloud region.
+	Region string
+	// Zone is nested under Region, e.g. an availability zone.
+	Zone string
+	// SubZone is nested under Zone, e.g. a rack or local zone.
+	SubZone string
+}
+
+// localityLabel* are the well-known label keys Locality rides on while it
+// waits for a real api/types field; these are read/written by ServerLocality
+// and stampLocality instead of a dedicated struct field.
+const (
+	localityLabelRegion  = "teleport.internal/locality-region"
+	localityLabelZone    = "teleport.internal/locality-zone"
+	localityLabelSubZone = "teleport.internal/locality-subzone"
+)
+
+// ServerLocality reads the Locality a node, proxy or auth server reported
+// for itself, as stamped by LocalityAwarePresence at upsert time. A server
+// with no locality labels returns the zero Locality.
+func ServerLocality(server types.Server) Locality {
+	labels := server.GetAllLabels()
+	return Locality{
+		Region:  labels[localityLabelRegion],
+		Zone:    labels[localityLabelZone],
+		SubZone: labels[localityLabelSubZone],
+	}
+}
+
+// stampLocality writes l onto server's labels so ServerLocality can read it
+// back. It's a no-op for zero Localities and for server kinds that don't
+// expose a mutable label map.
+func stampLocality(server types.Server, l Locality) {
+	if l == (Locality{}) {
+		return
+	}
+	sv2, ok := server.(*types.ServerV2)
+	if !ok {
+		return
+	}
+	if sv2.Metadata.Labels == nil {
+		sv2.Metadata.Labels = make(map[string]string, 3)
+	}
+	if l.Region != "" {
+		sv2.Metadata.Labels[localityLabelRegion] = l.Region
+	}
+	if l.Zone != "" {
+		sv2.Metadata.Labels[localityLabelZone] = l.Zone
+	}
+	if l.SubZone != "" {
+		sv2.Metadata.Labels[localityLabelSubZone] = l.SubZone
+	}
+}
+
+// LocalityAwarePresence wraps a Presence, stamping locality onto every
+// server upserted through UpsertNode/UpsertAuthServer/UpsertProxy before
+// delegating to the wrapped Presence. It embeds Presence so it only has to
+// override the three methods the request calls out; everything else passes
+// straight through.
+type LocalityAwarePresence struct {
+	Presence
+	// Locality is stamped onto every server this wrapper upserts; build it
+	// with DetectLocality.
+	Locality Locality
+}
+
+// NewLocalityAwarePresence wraps presence so that every node, auth server
+// and proxy it registers carries locality.
+func NewLocalityAwarePresence(presence Presence, locality Locality) *LocalityAwarePresence {
+	return &LocalityAwarePresence{Presence: presence, Locality: locality}
+}
+
+func (p *LocalityAwarePresence) UpsertNode(server types.Server) (*types.KeepAlive, error) {
+	stampLocality(server, p.Locality)
+	return p.Presence.UpsertNode(server)
+}
+
+func (p *LocalityAwarePresence) UpsertAuthServer(server types.Server) error {
+	stampLocality(server, p.Locality)
+	return p.Presence.UpsertAuthServer(server)
+}
+
+func (p *LocalityAwarePresence) UpsertProxy(server types.Server) error {
+	stampLocality(server, p.Locality)
+	return p.Presence.UpsertProxy(server)
+}
+
+// matchScore ranks how closely other matches l, higher is better. A zero
+// score means no locality overlap at all.
+func (l Locality) matchScore(other Locality) int {
+	switch {
+	case l.Region == "" || other.Region == "" || l.Region != other.Region:
+		return 0
+	case l.Zone == "" || other.Zone == "" || l.Zone != other.Zone:
+		// region matches, zone doesn't (or isn't set)
+		return 1
+	case l.SubZone == "" || other.SubZone == "" || l.SubZone != other.SubZone:
+		// region and zone match, sub-zone doesn't (or isn't set)
+		return 2
+	default:
+		// region, zone and sub-zone all match
+		return 3
+	}
+}
+
+// TunnelCandidate pairs a reverse tunnel with the locality of the proxy that
+// terminates it, so that SelectTunnelByLocality can rank candidates without
+// needing locality plumbed onto types.ReverseTunnel itself.
+type TunnelCandidate struct {
+	Tunnel        types.ReverseTunnel
+	ProxyLocality Locality
+}
+
+// LocalityPolicy governs whether reverse-tunnel selection prioritizes
+// locality for a given trusted cluster. It corresponds to the
+// PrioritizeByLocality field the request asks for on
+// TrustedCluster/RemoteCluster; api/types doesn't carry it yet, so callers
+// read it from their own TrustedCluster config and build one of these to
+// pass to SelectTunnelByLocality/SelectReverseTunnelForCluster instead.
+type LocalityPolicy struct {
+	// PrioritizeByLocality enables locality-aware tunnel selection. When
+	// false, the first candidate (by caller ordering) always wins.
+	PrioritizeByLocality bool
+}
+
+// SelectTunnelByLocality picks the best reverse tunnel for a caller at
+// callerLocality out of candidates. When policy.PrioritizeByLocality is
+// false, or none of the candidates share any locality with the caller, the
+// first candidate is returned as a fallback (callers are expected to pass
+// candidates already filtered down to healthy/online tunnels).
+//
+// Tie-break order is region match > zone match > sub-zone match; among
+// candidates with an equal score, the first one listed wins so that caller
+// ordering (e.g. most-recently-heartbeated first) is preserved.
+func SelectTunnelByLocality(policy LocalityPolicy, callerLocality Locality, candidates []TunnelCandidate) (types.ReverseTunnel, error) {
+	if len(candidates) == 0 {
+		return nil, trace.NotFound("no reverse tunnel candidates available")
+	}
+
+	if !policy.PrioritizeByLocality {
+		return candidates[0].Tunnel, nil
+	}
+
+	best := candidates[0]
+	bestScore := callerLocality.matchScore(best.ProxyLocality)
+	for _, c := range candidates[1:] {
+		if score := callerLocality.matchScore(c.ProxyLocality); score > bestScore {
+			best, bestScore = c, score
+		}
+	}
+	return best.Tunnel, nil
+}
+
+// Cloud metadata environment variables read by DetectLocality as a last
+// resort, for deployments that already resolve these out-of-band (e.g. via
+// the cloud provider's downward-API environment injection) and would
+// rather not have the auth/node process query IMDS itself.
+const (
+	EnvLocalityRegion  = "TELEPORT_LOCALITY_REGION"
+	EnvLocalityZone    = "TELEPORT_LOCALITY_ZONE"
+	EnvLocalitySubZone = "TELEPORT_LOCALITY_SUBZONE"
+)
+
+// imdsTimeout bounds each cloud metadata request DetectLocality makes.
+// IMDS endpoints are link-local and either answer almost instantly or
+// aren't reachable at all (wrong cloud, or blocked), so this stays short.
+const imdsTimeout = 2 * time.Second
+
+// DetectLocality returns the locality a node, proxy or auth server should
+// report for itself. configured, when non-zero, is an explicit value from
+// node config and always wins. Otherwise it probes EC2, then GCE, then
+// Azure IMDS in turn, and finally falls back to the EnvLocalityRegion/Zone/
+// SubZone environment variables if none of those respond.
+func DetectLocality(configured Locality) Locality {
+	if configured != (Locality{}) {
+		return configured
+	}
+
+	client := &http.Client{Timeout: imdsTimeout}
+	for _, detect := range imdsDetectors {
+		if l, ok := detect(client); ok {
+			return l
+		}
+	}
+
+	return Locality{
+		Region:  os.Getenv(EnvLocalityRegion),
+		Zone:    os.Getenv(EnvLocalityZone),
+		SubZone: os.Getenv(EnvLocalitySubZone),
+	}
+}
+
+// imdsDetectors is the ordered list of cloud metadata probes DetectLocality
+// tries before falling back to environment variables. It's a package-level
+// var, rather than inlined into DetectLocality, so tests can replace it
+// with stubs instead of making real network calls to link-local addresses.
+var imdsDetectors = []func(*http.Client) (Locality, bool){detectEC2Locality, detectGCELocality, detectAzureLocality}
+
+// fetchIMDS issues a GET against an instance metadata endpoint with the
+// given headers and returns the response body. Any failure (unreachable,
+// timeout, non-200) is reported as ok == false rather than an error, since
+// "this isn't that cloud" is an expected outcome, not a real error.
+func fetchIMDS(client *http.Client, method, url string, headers map[string]string) (string, bool) {
+	req, err := http.NewRequest(method, url, nil)
+	if err != nil {
+		return "", false
+	}
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", false
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", false
+	}
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", false
+	}
+	return string(body), true
+}
+
+// detectEC2Locality queries the EC2 instance metadata service (IMDSv2) for
+// the instance's availability zone and region.
+func detectEC2Locality(client *http.Client) (Locality, bool) {
+	token, ok := fetchIMDS(client, http.MethodPut, "http://169.254.169.254/latest/api/token",
+		map[string]string{"X-aws-ec2-metadata-token-ttl-seconds": "21600"})
+	if !ok {
+		return Locality{}, false
+	}
+
+	az, ok := fetchIMDS(client, http.MethodGet, "http://169.254.169.254/latest/meta-data/placement/availability-zone",
+		map[string]string{"X-aws-ec2-metadata-token": token})
+	if !ok {
+		return Locality{}, false
+	}
+	az = strings.TrimSpace(az)
+
+	region, ok := fetchIMDS(client, http.MethodGet, "http://169.254.169.254/latest/meta-data/placement/region",
+		map[string]string{"X-aws-ec2-metadata-token": token})
+	if !ok {
+		// Every AZ name is its region with a trailing letter, e.g.
+		// us-east-1a -> us-east-1; fall back to deriving it rather than
+		// failing detection outright over a second request.
+		region = strings.TrimRight(az, "abcdefghijklmnopqrstuvwxyz")
+	}
+	return Locality{Region: strings.TrimSpace(region), Zone: az}, true
+}
+
+// detectGCELocality queries the GCE metadata server for the instance's zone.
+func detectGCELocality(client *http.Client) (Locality, bool) {
+	zonePath, ok := fetchIMDS(client, http.MethodGet, "http://metadata.google.internal/computeMetadata/v1/instance/zone",
+		map[string]string{"Metadata-Flavor": "Google"})
+	if !ok {
+		return Locality{}, false
+	}
+
+	// zonePath looks like "projects/123456789/zones/us-central1-a".
+	parts := strings.Split(strings.TrimSpace(zonePath), "/")
+	zone := parts[len(parts)-1]
+	region := zone
+	if idx := strings.LastIndex(zone, "-"); idx != -1 {
+		region = zone[:idx]
+	}
+	return Locality{Region: region, Zone: zone}, true
+}
+
+// detectAzureLocality queries the Azure instance metadata service for the
+// instance's location and zone.
+func detectAzureLocality(client *http.Client) (Locality, bool) {
+	body, ok := fetchIMDS(client, http.MethodGet, "http://169.254.169.254/metadata/instance/compute?api-version=2021-02-01",
+		map[string]string{"Metadata": "true"})
+	if !ok {
+		return Locality{}, false
+	}
+
+	var compute struct {
+		Location string `json:"location"`
+		Zone     string `json:"zone"`
+	}
+	if err := json.Unmarshal([]byte(body), &compute); err != nil || compute.Location == "" {
+		return Locality{}, false
+	}
+	return Locality{Region: compute.Location, Zone: compute.Zone}, true
+}
+
+// ProxyLocator resolves the locality of the proxy terminating tunnel, so
+// that SelectReverseTunnelForCluster can rank the tunnels Presence already
+// knows about without types.ReverseTunnel having a Locality field of its
+// own.
+type ProxyLocator func(tunnel types.ReverseTunnel) Locality
+
+// SelectReverseTunnelForCluster picks a reverse tunnel for clusterName out
+// of presence's registered tunnels, preferring one whose proxy shares
+// locality with callerLocality per policy. This is the call site
+// TrustedCluster/RemoteCluster routing is expected to use once
+// PrioritizeByLocality exists as a field there; until then, callers build a
+// LocalityPolicy from wherever their trusted-cluster config lives.
+func SelectReverseTunnelForCluster(presence Presence, clusterName string, policy LocalityPolicy, callerLocality Locality, locate ProxyLocator) (types.ReverseTunnel, error) {
+	tunnels, err := presence.GetReverseTunnels()
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+
+	var candidates []TunnelCandidate
+	for _, tunnel := range tunnels {
+		if tunnel.GetClusterName() != clusterName {
+			continue
+		}
+		candidates = append(candidates, TunnelCandidate{Tunnel: tunnel, ProxyLocality: locate(tunnel)})
+	}
+	if len(candidates) == 0 {
+		return nil, trace.NotFound("no reverse tunnel registered for cluster %q", clusterName)
+	}
+
+	return SelectTunnelByLocality(policy, callerLocality, candidates)
+}
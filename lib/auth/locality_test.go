@@ -0,0 +1,198 @@
+/*
+Copyright 2021 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package auth
+
+import (
+	"net/http"
+	"os"
+	"testing"
+
+	"github.com/gravitational/teleport/api/types"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeTunnel embeds the (external) types.ReverseTunnel interface so it
+// satisfies it for the purposes of this test without needing to stub out
+// every method; SelectTunnelByLocality never calls into the tunnel itself,
+// it only consults the candidate's ProxyLocality.
+type fakeTunnel struct {
+	types.ReverseTunnel
+	id          string
+	clusterName string
+}
+
+func (f *fakeTunnel) GetClusterName() string {
+	return f.clusterName
+}
+
+func TestSelectTunnelByLocality(t *testing.T) {
+	t.Parallel()
+
+	caller := Locality{Region: "us-east-1", Zone: "us-east-1a", SubZone: "rack-1"}
+
+	candidates := []TunnelCandidate{
+		{Tunnel: &fakeTunnel{id: "no-match"}, ProxyLocality: Locality{Region: "eu-west-1", Zone: "eu-west-1a"}},
+		{Tunnel: &fakeTunnel{id: "region-only"}, ProxyLocality: Locality{Region: "us-east-1", Zone: "us-east-1b"}},
+		{Tunnel: &fakeTunnel{id: "region-and-zone"}, ProxyLocality: Locality{Region: "us-east-1", Zone: "us-east-1a", SubZone: "rack-9"}},
+		{Tunnel: &fakeTunnel{id: "exact"}, ProxyLocality: Locality{Region: "us-east-1", Zone: "us-east-1a", SubZone: "rack-1"}},
+	}
+
+	prioritized := LocalityPolicy{PrioritizeByLocality: true}
+	disabled := LocalityPolicy{PrioritizeByLocality: false}
+
+	t.Run("prioritized selection picks the closest locality", func(t *testing.T) {
+		t.Parallel()
+		got, err := SelectTunnelByLocality(prioritized, caller, candidates)
+		require.NoError(t, err)
+		require.Equal(t, "exact", got.(*fakeTunnel).id)
+	})
+
+	t.Run("disabled policy falls back to first candidate", func(t *testing.T) {
+		t.Parallel()
+		got, err := SelectTunnelByLocality(disabled, caller, candidates)
+		require.NoError(t, err)
+		require.Equal(t, "no-match", got.(*fakeTunnel).id)
+	})
+
+	t.Run("falls back to first candidate when nothing matches", func(t *testing.T) {
+		t.Parallel()
+		mismatched := []TunnelCandidate{
+			{Tunnel: &fakeTunnel{id: "a"}, ProxyLocality: Locality{Region: "eu-west-1"}},
+			{Tunnel: &fakeTunnel{id: "b"}, ProxyLocality: Locality{Region: "ap-south-1"}},
+		}
+		got, err := SelectTunnelByLocality(prioritized, caller, mismatched)
+		require.NoError(t, err)
+		require.Equal(t, "a", got.(*fakeTunnel).id)
+	})
+
+	t.Run("errors on empty candidate list", func(t *testing.T) {
+		t.Parallel()
+		_, err := SelectTunnelByLocality(prioritized, caller, nil)
+		require.Error(t, err)
+	})
+}
+
+// fakePresence embeds the (external) Presence interface so it satisfies it
+// without stubbing every method; only GetReverseTunnels is overridden.
+type fakePresence struct {
+	Presence
+	tunnels []types.ReverseTunnel
+}
+
+func (f *fakePresence) GetReverseTunnels(opts ...MarshalOption) ([]types.ReverseTunnel, error) {
+	return f.tunnels, nil
+}
+
+func TestSelectReverseTunnelForCluster(t *testing.T) {
+	t.Parallel()
+
+	caller := Locality{Region: "us-east-1", Zone: "us-east-1a"}
+	localities := map[string]Locality{
+		"near": {Region: "us-east-1", Zone: "us-east-1a"},
+		"far":  {Region: "eu-west-1", Zone: "eu-west-1a"},
+	}
+	locate := func(tunnel types.ReverseTunnel) Locality {
+		return localities[tunnel.(*fakeTunnel).id]
+	}
+
+	presence := &fakePresence{tunnels: []types.ReverseTunnel{
+		&fakeTunnel{id: "far", clusterName: "leaf"},
+		&fakeTunnel{id: "near", clusterName: "leaf"},
+		&fakeTunnel{id: "other-cluster", clusterName: "other"},
+	}}
+
+	policy := LocalityPolicy{PrioritizeByLocality: true}
+	got, err := SelectReverseTunnelForCluster(presence, "leaf", policy, caller, locate)
+	require.NoError(t, err)
+	require.Equal(t, "near", got.(*fakeTunnel).id)
+
+	_, err = SelectReverseTunnelForCluster(presence, "nonexistent", policy, caller, locate)
+	require.Error(t, err)
+}
+
+func TestDetectLocality(t *testing.T) {
+	// Replace the real IMDS probes with stubs so this doesn't depend on
+	// actually running on EC2/GCE/Azure (or on the link-local address being
+	// unreachable quickly in whatever environment the test runs in).
+	realDetectors := imdsDetectors
+	imdsDetectors = []func(*http.Client) (Locality, bool){
+		func(*http.Client) (Locality, bool) { return Locality{}, false },
+	}
+	defer func() { imdsDetectors = realDetectors }()
+
+	t.Run("explicit config wins", func(t *testing.T) {
+		got := DetectLocality(Locality{Region: "us-east-1"})
+		require.Equal(t, Locality{Region: "us-east-1"}, got)
+	})
+
+	t.Run("falls back to environment when no IMDS responds", func(t *testing.T) {
+		os.Setenv(EnvLocalityRegion, "eu-west-1")
+		os.Setenv(EnvLocalityZone, "eu-west-1a")
+		defer os.Unsetenv(EnvLocalityRegion)
+		defer os.Unsetenv(EnvLocalityZone)
+
+		got := DetectLocality(Locality{})
+		require.Equal(t, Locality{Region: "eu-west-1", Zone: "eu-west-1a"}, got)
+	})
+
+	t.Run("uses whichever IMDS probe answers first", func(t *testing.T) {
+		imdsDetectors = []func(*http.Client) (Locality, bool){
+			func(*http.Client) (Locality, bool) { return Locality{}, false },
+			func(*http.Client) (Locality, bool) {
+				return Locality{Region: "us-central1", Zone: "us-central1-a"}, true
+			},
+		}
+		got := DetectLocality(Locality{})
+		require.Equal(t, Locality{Region: "us-central1", Zone: "us-central1-a"}, got)
+	})
+}
+
+func TestServerLocalityRoundTrip(t *testing.T) {
+	t.Parallel()
+
+	server := &types.ServerV2{Metadata: types.Metadata{Name: "node-1"}}
+	require.Equal(t, Locality{}, ServerLocality(server))
+
+	stampLocality(server, Locality{Region: "us-east-1", Zone: "us-east-1a"})
+	require.Equal(t, Locality{Region: "us-east-1", Zone: "us-east-1a"}, ServerLocality(server))
+}
+
+// fakeUpsertPresence embeds the (external) Presence interface and records
+// the server it was last asked to upsert, so LocalityAwarePresence can be
+// tested without a real backend.
+type fakeUpsertPresence struct {
+	Presence
+	lastUpserted types.Server
+}
+
+func (f *fakeUpsertPresence) UpsertNode(server types.Server) (*types.KeepAlive, error) {
+	f.lastUpserted = server
+	return nil, nil
+}
+
+func TestLocalityAwarePresenceStampsOnUpsert(t *testing.T) {
+	t.Parallel()
+
+	inner := &fakeUpsertPresence{}
+	wrapped := NewLocalityAwarePresence(inner, Locality{Region: "us-east-1", Zone: "us-east-1a"})
+
+	server := &types.ServerV2{Metadata: types.Metadata{Name: "node-1"}}
+	_, err := wrapped.UpsertNode(server)
+	require.NoError(t, err)
+
+	require.Equal(t, Locality{Region: "us-east-1", Zone: "us-east-1a"}, ServerLocality(inner.lastUpserted))
+}
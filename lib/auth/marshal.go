@@ -0,0 +1,61 @@
+/*
+Copyright 2021 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package auth
+
+import "github.com/gravitational/trace"
+
+// MarshalConfig holds the options collected from a MarshalOption list.
+type MarshalConfig struct {
+	// Version is the resource version to marshal/unmarshal as. Empty means
+	// "use the version already on the resource".
+	Version string
+	// SkipValidation skips schema validation, trading safety for speed on
+	// hot paths (e.g. bulk listing calls) that already trust their source.
+	SkipValidation bool
+}
+
+// MarshalOption sets a MarshalConfig field. Presence listing and CRUD
+// methods take a variadic list of these so callers can opt into
+// version pinning or validation skipping without changing every call site.
+type MarshalOption func(*MarshalConfig) error
+
+// CollectOptions parses a list of MarshalOption into a single MarshalConfig.
+func CollectOptions(opts []MarshalOption) (*MarshalConfig, error) {
+	cfg := &MarshalConfig{}
+	for _, opt := range opts {
+		if err := opt(cfg); err != nil {
+			return nil, trace.Wrap(err)
+		}
+	}
+	return cfg, nil
+}
+
+// WithVersion pins the resource version used for marshaling.
+func WithVersion(v string) MarshalOption {
+	return func(c *MarshalConfig) error {
+		c.Version = v
+		return nil
+	}
+}
+
+// SkipValidation skips schema validation for this call.
+func SkipValidation() MarshalOption {
+	return func(c *MarshalConfig) error {
+		c.SkipValidation = true
+		return nil
+	}
+}
@@ -0,0 +1,205 @@
+/*
+Copyright 2021 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package auth
+
+import (
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/gravitational/trace"
+)
+
+// evalPredicate evaluates a small boolean expression language over a
+// resource's labels. Supported grammar:
+//
+//	expr       := orExpr
+//	orExpr     := andExpr ( "||" andExpr )*
+//	andExpr    := term ( "&&" term )*
+//	term       := "(" expr ")" | comparison | call
+//	comparison := operand ( "==" | "!=" ) operand
+//	call       := "contains" "(" operand "," operand ")"
+//	operand    := `labels["key"]` | string literal
+//
+// It is intentionally tiny: just enough to express the label predicates
+// operators need for server-side filtering, not a general purpose CEL/JMESPath
+// replacement.
+func evalPredicate(expr string, labels map[string]string) (bool, error) {
+	p := &predicateParser{input: expr, labels: labels}
+	result, err := p.parseOr()
+	if err != nil {
+		return false, trace.Wrap(err)
+	}
+	p.skipSpace()
+	if p.pos != len(p.input) {
+		return false, trace.BadParameter("unexpected trailing input in predicate expression %q at position %d", expr, p.pos)
+	}
+	return result, nil
+}
+
+type predicateParser struct {
+	input  string
+	pos    int
+	labels map[string]string
+}
+
+func (p *predicateParser) skipSpace() {
+	for p.pos < len(p.input) && unicode.IsSpace(rune(p.input[p.pos])) {
+		p.pos++
+	}
+}
+
+func (p *predicateParser) hasPrefix(s string) bool {
+	p.skipSpace()
+	return strings.HasPrefix(p.input[p.pos:], s)
+}
+
+func (p *predicateParser) consume(s string) bool {
+	if p.hasPrefix(s) {
+		p.pos += len(s)
+		return true
+	}
+	return false
+}
+
+func (p *predicateParser) parseOr() (bool, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return false, trace.Wrap(err)
+	}
+	for p.consume("||") {
+		right, err := p.parseAnd()
+		if err != nil {
+			return false, trace.Wrap(err)
+		}
+		left = left || right
+	}
+	return left, nil
+}
+
+func (p *predicateParser) parseAnd() (bool, error) {
+	left, err := p.parseTerm()
+	if err != nil {
+		return false, trace.Wrap(err)
+	}
+	for p.consume("&&") {
+		right, err := p.parseTerm()
+		if err != nil {
+			return false, trace.Wrap(err)
+		}
+		left = left && right
+	}
+	return left, nil
+}
+
+func (p *predicateParser) parseTerm() (bool, error) {
+	if p.consume("(") {
+		result, err := p.parseOr()
+		if err != nil {
+			return false, trace.Wrap(err)
+		}
+		if !p.consume(")") {
+			return false, trace.BadParameter("predicate expression missing closing paren at position %d", p.pos)
+		}
+		return result, nil
+	}
+
+	if p.hasPrefix("contains(") {
+		return p.parseContains()
+	}
+
+	return p.parseComparison()
+}
+
+func (p *predicateParser) parseContains() (bool, error) {
+	p.consume("contains(")
+	haystack, err := p.parseOperand()
+	if err != nil {
+		return false, trace.Wrap(err)
+	}
+	if !p.consume(",") {
+		return false, trace.BadParameter("contains() expects two comma-separated arguments")
+	}
+	needle, err := p.parseOperand()
+	if err != nil {
+		return false, trace.Wrap(err)
+	}
+	if !p.consume(")") {
+		return false, trace.BadParameter("contains() missing closing paren at position %d", p.pos)
+	}
+	return strings.Contains(haystack, needle), nil
+}
+
+func (p *predicateParser) parseComparison() (bool, error) {
+	left, err := p.parseOperand()
+	if err != nil {
+		return false, trace.Wrap(err)
+	}
+
+	switch {
+	case p.consume("=="):
+		right, err := p.parseOperand()
+		if err != nil {
+			return false, trace.Wrap(err)
+		}
+		return left == right, nil
+	case p.consume("!="):
+		right, err := p.parseOperand()
+		if err != nil {
+			return false, trace.Wrap(err)
+		}
+		return left != right, nil
+	default:
+		return false, trace.BadParameter("expected comparison operator (== or !=) at position %d", p.pos)
+	}
+}
+
+// parseOperand parses either a `labels["key"]` lookup or a quoted string
+// literal, returning its string value.
+func (p *predicateParser) parseOperand() (string, error) {
+	p.skipSpace()
+
+	if p.consume(`labels[`) {
+		key, err := p.parseStringLiteral()
+		if err != nil {
+			return "", trace.Wrap(err)
+		}
+		if !p.consume("]") {
+			return "", trace.BadParameter(`expected closing "]" after labels[...] at position %d`, p.pos)
+		}
+		return p.labels[key], nil
+	}
+
+	return p.parseStringLiteral()
+}
+
+func (p *predicateParser) parseStringLiteral() (string, error) {
+	p.skipSpace()
+	if p.pos >= len(p.input) || p.input[p.pos] != '"' {
+		return "", trace.BadParameter("expected string literal at position %d", p.pos)
+	}
+	end := strings.IndexByte(p.input[p.pos+1:], '"')
+	if end < 0 {
+		return "", trace.BadParameter("unterminated string literal at position %d", p.pos)
+	}
+	value, err := strconv.Unquote(p.input[p.pos : p.pos+end+2])
+	if err != nil {
+		return "", trace.BadParameter("invalid string literal at position %d: %v", p.pos, err)
+	}
+	p.pos += end + 2
+	return value, nil
+}
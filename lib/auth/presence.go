@@ -32,8 +32,10 @@ type Presence interface {
 	GetLocalClusterName() (string, error)
 
 	// GetNodes returns a list of registered servers. Schema validation can be
-	// skipped to improve performance.
-	GetNodes(namespace string, opts ...MarshalOption) ([]types.Server, error)
+	// skipped to improve performance. When filter is non-empty, only servers
+	// matching it are returned; matching is evaluated server-side so the
+	// rest of the list never has to be decoded or sent over the wire.
+	GetNodes(namespace string, filter ResourceFilter, opts ...MarshalOption) ([]types.Server, error)
 
 	// DeleteAllNodes deletes all nodes in a namespace.
 	DeleteAllNodes(namespace string) error
@@ -48,6 +50,13 @@ type Presence interface {
 	// UpsertNodes bulk inserts nodes.
 	UpsertNodes(namespace string, servers []types.Server) error
 
+	// UpsertNodesStream bulk inserts nodes read from a channel, in
+	// configurable batches, emitting a per-node UpsertResult instead of
+	// rejecting the whole call on the first invalid record. It is meant for
+	// large (10k+) fleet imports; see StreamUpsertNodes for batching and
+	// error-handling semantics.
+	UpsertNodesStream(ctx context.Context, namespace string, nodes <-chan types.Server, opts ...StreamOption) (<-chan UpsertResult, error)
+
 	// DELETE IN: 5.1.0
 	//
 	// This logic has been moved to KeepAliveServer.
@@ -67,6 +76,11 @@ type Presence interface {
 	UpsertProxy(server types.Server) error
 
 	// ProxyGetter gets a list of proxies
+	//
+	// ProxyGetter is defined in api/types and predates ResourceFilter, so it
+	// has no filter parameter of its own; callers that need filtered proxy
+	// listings apply ApplyServerFilter to GetProxies()'s result instead (see
+	// APIServer.getProxies for the REST endpoint that does this).
 	types.ProxyGetter
 
 	// DeleteProxy deletes proxy by name
@@ -147,8 +161,9 @@ type Presence interface {
 	// UpsertKubeService registers kubernetes service presence.
 	UpsertKubeService(context.Context, types.Server) error
 
-	// GetAppServers gets all application servers.
-	GetAppServers(context.Context, string, ...MarshalOption) ([]types.Server, error)
+	// GetAppServers gets all application servers, narrowed to those matching
+	// filter when it is non-empty.
+	GetAppServers(context.Context, string, ResourceFilter, ...MarshalOption) ([]types.Server, error)
 
 	// UpsertAppServer adds an application server.
 	UpsertAppServer(context.Context, types.Server) (*types.KeepAlive, error)
@@ -159,8 +174,9 @@ type Presence interface {
 	// DeleteAllAppServers removes all application servers.
 	DeleteAllAppServers(context.Context, string) error
 
-	// GetDatabaseServers returns all registered database proxy servers.
-	GetDatabaseServers(context.Context, string, ...MarshalOption) ([]types.DatabaseServer, error)
+	// GetDatabaseServers returns all registered database proxy servers,
+	// narrowed to those matching filter when it is non-empty.
+	GetDatabaseServers(context.Context, string, ResourceFilter, ...MarshalOption) ([]types.DatabaseServer, error)
 	// UpsertDatabaseServer creates or updates a new database proxy server.
 	UpsertDatabaseServer(context.Context, types.DatabaseServer) (*types.KeepAlive, error)
 	// DeleteDatabaseServer removes the specified database proxy server.
@@ -171,8 +187,21 @@ type Presence interface {
 	// KeepAliveServer updates TTL of the server resource in the backend.
 	KeepAliveServer(ctx context.Context, h types.KeepAlive) error
 
-	// GetKubeServices returns a list of registered kubernetes services.
-	GetKubeServices(context.Context) ([]types.Server, error)
+	// GetKubeServices returns a list of registered kubernetes services,
+	// narrowed to those matching filter when it is non-empty.
+	GetKubeServices(context.Context, ResourceFilter) ([]types.Server, error)
+
+	// UpsertSamenessGroup creates or updates a SamenessGroup in the backend.
+	UpsertSamenessGroup(ctx context.Context, sg SamenessGroup) (SamenessGroup, error)
+
+	// GetSamenessGroup returns a single SamenessGroup by name.
+	GetSamenessGroup(ctx context.Context, name string) (SamenessGroup, error)
+
+	// ListSamenessGroups returns all SamenessGroups in the backend.
+	ListSamenessGroups(ctx context.Context) ([]SamenessGroup, error)
+
+	// DeleteSamenessGroup removes a SamenessGroup from the backend by name.
+	DeleteSamenessGroup(ctx context.Context, name string) error
 
 	// DeleteKubeService deletes a named kubernetes service.
 	DeleteKubeService(ctx context.Context, name string) error
@@ -0,0 +1,133 @@
+/*
+Copyright 2021 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package auth
+
+import (
+	"strings"
+
+	"github.com/gravitational/trace"
+
+	"github.com/gravitational/teleport/api/types"
+)
+
+// labeledResource is the minimal surface ResourceFilter needs from a
+// resource in order to evaluate labels, name and search keywords against
+// it. types.Server, types.DatabaseServer and friends all satisfy it.
+type labeledResource interface {
+	// GetName returns the resource name.
+	GetName() string
+	// GetAllLabels returns the resource's static and dynamic labels merged
+	// into a single map.
+	GetAllLabels() map[string]string
+}
+
+// ResourceFilter describes a server-side predicate used to narrow down
+// Presence listing calls (GetNodes, GetAppServers, GetDatabaseServers,
+// GetKubeServices) so that callers like tsh don't have to pull every
+// resource in a namespace/cluster across the wire before filtering
+// client-side.
+//
+// TODO: promote this to api/types once the filter is stable, so that
+// api clients can build requests against it directly.
+type ResourceFilter struct {
+	// Labels, when non-empty, matches resources whose labels are a superset
+	// of Labels.
+	Labels map[string]string
+	// SearchKeywords matches resources that contain all of the given
+	// keywords in their name, labels or command output, case-insensitively.
+	SearchKeywords []string
+	// PredicateExpression is a boolean expression over a resource's labels,
+	// e.g. `labels["env"] == "prod" && contains(labels["team"], "core")`.
+	PredicateExpression string
+}
+
+// IsEmpty reports whether the filter has no constraints, i.e. whether
+// applying it is a no-op.
+func (f ResourceFilter) IsEmpty() bool {
+	return len(f.Labels) == 0 && len(f.SearchKeywords) == 0 && f.PredicateExpression == ""
+}
+
+// Match evaluates the filter against a labeled resource. A nil or empty
+// filter always matches.
+func (f ResourceFilter) Match(resource labeledResource) (bool, error) {
+	if f.IsEmpty() {
+		return true, nil
+	}
+
+	labels := resource.GetAllLabels()
+
+	for k, v := range f.Labels {
+		if labels[k] != v {
+			return false, nil
+		}
+	}
+
+	if len(f.SearchKeywords) > 0 && !matchSearchKeywords(resource, f.SearchKeywords) {
+		return false, nil
+	}
+
+	if f.PredicateExpression != "" {
+		match, err := evalPredicate(f.PredicateExpression, labels)
+		if err != nil {
+			return false, trace.Wrap(err)
+		}
+		if !match {
+			return false, nil
+		}
+	}
+
+	return true, nil
+}
+
+// cmdLabeledResource is implemented by resources (types.Server and
+// friends) that carry command labels, whose Result is the last output of
+// the periodically re-run command. It's a separate, optional interface
+// rather than part of labeledResource because not every resource
+// ResourceFilter matches against has command labels.
+type cmdLabeledResource interface {
+	GetCmdLabels() map[string]types.CommandLabel
+}
+
+// matchSearchKeywords reports whether every keyword appears, case
+// insensitively, in the resource's name, one of its label values, or (for
+// resources that have them) the output of one of its command labels.
+func matchSearchKeywords(resource labeledResource, keywords []string) bool {
+	fields := []string{resource.GetName()}
+	for k, v := range resource.GetAllLabels() {
+		fields = append(fields, k, v)
+	}
+	if cmd, ok := resource.(cmdLabeledResource); ok {
+		for k, label := range cmd.GetCmdLabels() {
+			fields = append(fields, k, label.GetResult())
+		}
+	}
+
+	for _, kw := range keywords {
+		kw = strings.ToLower(kw)
+		found := false
+		for _, field := range fields {
+			if strings.Contains(strings.ToLower(field), kw) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
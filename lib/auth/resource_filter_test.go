@@ -0,0 +1,148 @@
+/*
+Copyright 2021 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package auth
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/gravitational/teleport/api/types"
+)
+
+func TestResourceFilterMatch(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		desc   string
+		filter ResourceFilter
+		labels map[string]string
+		name   string
+		want   bool
+	}{
+		{
+			desc:   "empty filter always matches",
+			filter: ResourceFilter{},
+			labels: map[string]string{"env": "staging"},
+			want:   true,
+		},
+		{
+			desc:   "label filter matches subset",
+			filter: ResourceFilter{Labels: map[string]string{"env": "prod"}},
+			labels: map[string]string{"env": "prod", "team": "core"},
+			want:   true,
+		},
+		{
+			desc:   "label filter rejects mismatch",
+			filter: ResourceFilter{Labels: map[string]string{"env": "prod"}},
+			labels: map[string]string{"env": "staging"},
+			want:   false,
+		},
+		{
+			desc:   "search keywords match labels case-insensitively",
+			filter: ResourceFilter{SearchKeywords: []string{"core", "PROD"}},
+			labels: map[string]string{"env": "prod", "team": "core"},
+			name:   "db-1",
+			want:   true,
+		},
+		{
+			desc:   "search keywords require every term",
+			filter: ResourceFilter{SearchKeywords: []string{"missing"}},
+			labels: map[string]string{"env": "prod"},
+			name:   "db-1",
+			want:   false,
+		},
+		{
+			desc:   "predicate expression equality",
+			filter: ResourceFilter{PredicateExpression: `labels["env"] == "prod"`},
+			labels: map[string]string{"env": "prod"},
+			want:   true,
+		},
+		{
+			desc:   "predicate expression contains and and",
+			filter: ResourceFilter{PredicateExpression: `labels["env"] == "prod" && contains(labels["team"], "co")`},
+			labels: map[string]string{"env": "prod", "team": "core"},
+			want:   true,
+		},
+		{
+			desc:   "predicate expression or",
+			filter: ResourceFilter{PredicateExpression: `labels["env"] == "dev" || labels["env"] == "prod"`},
+			labels: map[string]string{"env": "prod"},
+			want:   true,
+		},
+		{
+			desc:   "predicate expression not equal",
+			filter: ResourceFilter{PredicateExpression: `labels["env"] != "prod"`},
+			labels: map[string]string{"env": "prod"},
+			want:   false,
+		},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.desc, func(t *testing.T) {
+			t.Parallel()
+			got, err := tt.filter.Match(&fakeLabeledResource{name: tt.name, labels: tt.labels})
+			require.NoError(t, err)
+			require.Equal(t, tt.want, got)
+		})
+	}
+}
+
+// fakeLabeledResource is a minimal stand-in for types.ResourceWithLabels
+// used to unit test the filter/predicate evaluator without a backend.
+type fakeLabeledResource struct {
+	name      string
+	labels    map[string]string
+	cmdLabels map[string]types.CommandLabel
+}
+
+func (f *fakeLabeledResource) GetName() string                 { return f.name }
+func (f *fakeLabeledResource) GetAllLabels() map[string]string { return f.labels }
+
+func (f *fakeLabeledResource) GetCmdLabels() map[string]types.CommandLabel {
+	return f.cmdLabels
+}
+
+// fakeCommandLabel embeds the (external) types.CommandLabel interface so it
+// satisfies it without stubbing every method; only GetResult is overridden.
+type fakeCommandLabel struct {
+	types.CommandLabel
+	result string
+}
+
+func (f fakeCommandLabel) GetResult() string { return f.result }
+
+func TestResourceFilterMatchSearchesCommandOutput(t *testing.T) {
+	t.Parallel()
+
+	resource := &fakeLabeledResource{
+		name:   "db-1",
+		labels: map[string]string{"env": "prod"},
+		cmdLabels: map[string]types.CommandLabel{
+			"uptime": fakeCommandLabel{result: "up 3 days"},
+		},
+	}
+
+	got, err := (ResourceFilter{SearchKeywords: []string{"3 days"}}).Match(resource)
+	require.NoError(t, err)
+	require.True(t, got, "search keywords should match command label output, not just name/labels")
+
+	got, err = (ResourceFilter{SearchKeywords: []string{"nonexistent"}}).Match(resource)
+	require.NoError(t, err)
+	require.False(t, got)
+}
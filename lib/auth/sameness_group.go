@@ -0,0 +1,149 @@
+/*
+Copyright 2021 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package auth
+
+import (
+	"context"
+
+	"github.com/gravitational/trace"
+)
+
+// SamenessGroup declares an ordered list of TrustedClusters that should be
+// treated as interchangeable for role/RBAC resolution and node lookup: if
+// the member a request would normally be routed to is offline, the auth
+// server transparently reroutes to the next online member instead of
+// failing the request.
+//
+// The natural home for this is a first-class types.SamenessGroup resource
+// in api/types, with Presence.UpsertSamenessGroup and friends (below) as
+// the CRUD surface a backend-cache implementation would satisfy against
+// it — that needs an api/types schema change this package can't make on
+// its own. Until it lands, SamenessGroup lives here instead, and
+// IsTrustedClusterOnline (also below) is what makes "offline" a real,
+// observable condition — whether the cluster currently has any tunnel
+// connections — rather than a caller-supplied stand-in.
+type SamenessGroup struct {
+	// Name uniquely identifies the group.
+	Name string
+	// Members lists the TrustedCluster names that belong to the group, in
+	// failover preference order; Members[0] is tried first.
+	Members []string
+}
+
+// CheckAndSetDefaults validates the group and is called before the group is
+// persisted.
+func (g *SamenessGroup) CheckAndSetDefaults() error {
+	if g.Name == "" {
+		return trace.BadParameter("sameness group name is required")
+	}
+	if len(g.Members) < 2 {
+		return trace.BadParameter("sameness group %q must declare at least two members", g.Name)
+	}
+	seen := make(map[string]struct{}, len(g.Members))
+	for _, m := range g.Members {
+		if m == "" {
+			return trace.BadParameter("sameness group %q has an empty member name", g.Name)
+		}
+		if _, ok := seen[m]; ok {
+			return trace.BadParameter("sameness group %q lists member %q more than once", g.Name, m)
+		}
+		seen[m] = struct{}{}
+	}
+	return nil
+}
+
+// ValidateSamenessGroupTrustChain checks that every member of the group
+// shares the same CA trust chain, identified by caPin (e.g. the SPKI pin of
+// the cluster's host CA). getCAPin is expected to look up the pin for a
+// given TrustedCluster name; CRUD implementations call this in addition to
+// CheckAndSetDefaults before persisting a group, since validating trust
+// requires access to the backend's TrustedCluster records.
+func ValidateSamenessGroupTrustChain(group SamenessGroup, getCAPin func(clusterName string) (string, error)) error {
+	var wantPin string
+	for i, member := range group.Members {
+		pin, err := getCAPin(member)
+		if err != nil {
+			return trace.Wrap(err, "resolving CA trust chain for sameness group member %q", member)
+		}
+		if i == 0 {
+			wantPin = pin
+			continue
+		}
+		if pin != wantPin {
+			return trace.BadParameter("sameness group %q member %q does not share the group's CA trust chain", group.Name, member)
+		}
+	}
+	return nil
+}
+
+// SamenessGroupFailoverEvent is emitted to the audit log whenever a request
+// is rerouted from an offline sameness-group member to an online one.
+type SamenessGroupFailoverEvent struct {
+	GroupName string
+	From      string
+	To        string
+}
+
+// SamenessGroupEmitter receives a SamenessGroupFailoverEvent so it can be
+// written to the audit log; it's a function rather than an interface so
+// callers can plug in whatever emitter (events.Emitter, a test spy, ...) is
+// in scope without this package depending on the audit log package.
+type SamenessGroupEmitter func(ctx context.Context, event SamenessGroupFailoverEvent)
+
+// SelectSamenessGroupMember returns the first member of the group that
+// isOnline reports as online, preserving the group's declared failover
+// order. It returns trace.NotFound if every member is offline. If the
+// selected member isn't group.Members[0], a SamenessGroupFailoverEvent
+// describing the reroute is passed to emit (when non-nil).
+func SelectSamenessGroupMember(ctx context.Context, group SamenessGroup, isOnline func(clusterName string) bool, emit SamenessGroupEmitter) (string, error) {
+	for _, member := range group.Members {
+		if !isOnline(member) {
+			continue
+		}
+		if member != group.Members[0] && emit != nil {
+			emit(ctx, SamenessGroupFailoverEvent{GroupName: group.Name, From: group.Members[0], To: member})
+		}
+		return member, nil
+	}
+	return "", trace.NotFound("no online member found in sameness group %q", group.Name)
+}
+
+// IsTrustedClusterOnline reports whether clusterName currently has any
+// reverse tunnel connections registered. A cluster whose connections have
+// all been deleted (the actual failover trigger, e.g. because its proxies
+// stopped dialing back) is treated as offline; this is the isOnline
+// implementation real call sites pass to ResolveSamenessGroupMember.
+func IsTrustedClusterOnline(presence Presence, clusterName string) bool {
+	conns, err := presence.GetTunnelConnections(clusterName)
+	if err != nil {
+		return false
+	}
+	return len(conns) > 0
+}
+
+// ResolveSamenessGroupMember looks groupName up in presence and returns the
+// TrustedCluster a request to it should actually be routed to, transparently
+// failing over to the next online member when the group's primary is
+// offline. This is the call site request routing is expected to use instead
+// of addressing a TrustedCluster directly once a member of a sameness group.
+func ResolveSamenessGroupMember(ctx context.Context, presence Presence, groupName string, isOnline func(clusterName string) bool, emit SamenessGroupEmitter) (string, error) {
+	group, err := presence.GetSamenessGroup(ctx, groupName)
+	if err != nil {
+		return "", trace.Wrap(err)
+	}
+	return SelectSamenessGroupMember(ctx, group, isOnline, emit)
+}
@@ -0,0 +1,219 @@
+/*
+Copyright 2021 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package auth
+
+import (
+	"context"
+	"sync"
+	"testing"
+
+	"github.com/gravitational/trace"
+	"github.com/stretchr/testify/require"
+
+	"github.com/gravitational/teleport/api/types"
+)
+
+func TestSamenessGroupCheckAndSetDefaults(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		desc      string
+		group     SamenessGroup
+		assertErr require.ErrorAssertionFunc
+	}{
+		{
+			desc:      "valid group",
+			group:     SamenessGroup{Name: "prod-regions", Members: []string{"us-east", "us-west"}},
+			assertErr: require.NoError,
+		},
+		{
+			desc:      "missing name",
+			group:     SamenessGroup{Members: []string{"us-east", "us-west"}},
+			assertErr: require.Error,
+		},
+		{
+			desc:      "too few members",
+			group:     SamenessGroup{Name: "prod-regions", Members: []string{"us-east"}},
+			assertErr: require.Error,
+		},
+		{
+			desc:      "duplicate member",
+			group:     SamenessGroup{Name: "prod-regions", Members: []string{"us-east", "us-east"}},
+			assertErr: require.Error,
+		},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.desc, func(t *testing.T) {
+			t.Parallel()
+			tt.assertErr(t, tt.group.CheckAndSetDefaults())
+		})
+	}
+}
+
+func TestSelectSamenessGroupMember(t *testing.T) {
+	t.Parallel()
+
+	group := SamenessGroup{Name: "prod-regions", Members: []string{"us-east", "us-west", "eu-central"}}
+	ctx := context.Background()
+
+	t.Run("picks first online member, no failover event", func(t *testing.T) {
+		t.Parallel()
+		online := map[string]bool{"us-east": true, "us-west": true}
+		var emitted []SamenessGroupFailoverEvent
+		emit := func(ctx context.Context, e SamenessGroupFailoverEvent) { emitted = append(emitted, e) }
+
+		got, err := SelectSamenessGroupMember(ctx, group, func(name string) bool { return online[name] }, emit)
+		require.NoError(t, err)
+		require.Equal(t, "us-east", got)
+		require.Empty(t, emitted)
+	})
+
+	t.Run("skips offline primary for next online member, emits failover event", func(t *testing.T) {
+		t.Parallel()
+		online := map[string]bool{"us-west": true}
+		var emitted []SamenessGroupFailoverEvent
+		emit := func(ctx context.Context, e SamenessGroupFailoverEvent) { emitted = append(emitted, e) }
+
+		got, err := SelectSamenessGroupMember(ctx, group, func(name string) bool { return online[name] }, emit)
+		require.NoError(t, err)
+		require.Equal(t, "us-west", got)
+		require.Equal(t, []SamenessGroupFailoverEvent{{GroupName: "prod-regions", From: "us-east", To: "us-west"}}, emitted)
+	})
+
+	t.Run("errors when every member is offline", func(t *testing.T) {
+		t.Parallel()
+		_, err := SelectSamenessGroupMember(ctx, group, func(name string) bool { return false }, nil)
+		require.True(t, trace.IsNotFound(err))
+	})
+}
+
+// fakeGroupPresence embeds the (external) Presence interface so it
+// satisfies it without stubbing every method; GetSamenessGroup and the
+// tunnel connection CRUD methods IsTrustedClusterOnline relies on are
+// overridden with an in-memory implementation.
+type fakeGroupPresence struct {
+	Presence
+	group SamenessGroup
+
+	mu          sync.Mutex
+	tunnelConns map[string][]types.TunnelConnection
+}
+
+func (f *fakeGroupPresence) GetSamenessGroup(ctx context.Context, name string) (SamenessGroup, error) {
+	if name != f.group.Name {
+		return SamenessGroup{}, trace.NotFound("sameness group %q not found", name)
+	}
+	return f.group, nil
+}
+
+func (f *fakeGroupPresence) UpsertTunnelConnection(conn types.TunnelConnection) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.tunnelConns == nil {
+		f.tunnelConns = make(map[string][]types.TunnelConnection)
+	}
+	f.tunnelConns[conn.GetClusterName()] = append(f.tunnelConns[conn.GetClusterName()], conn)
+	return nil
+}
+
+func (f *fakeGroupPresence) GetTunnelConnections(clusterName string, opts ...MarshalOption) ([]types.TunnelConnection, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.tunnelConns[clusterName], nil
+}
+
+func (f *fakeGroupPresence) DeleteTunnelConnections(clusterName string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.tunnelConns, clusterName)
+	return nil
+}
+
+// fakeTunnelConnection embeds the (external) types.TunnelConnection
+// interface so it satisfies it; only GetClusterName is overridden.
+type fakeTunnelConnection struct {
+	types.TunnelConnection
+	clusterName string
+}
+
+func (f *fakeTunnelConnection) GetClusterName() string { return f.clusterName }
+
+// TestResolveSamenessGroupMemberFailover exercises the scenario from the
+// original request: two remote clusters in a sameness group, the primary
+// marked offline by deleting its tunnel connections (not a caller-supplied
+// online/offline stand-in), traffic routed to the secondary instead of
+// failing.
+func TestResolveSamenessGroupMemberFailover(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	presence := &fakeGroupPresence{group: SamenessGroup{
+		Name:    "prod-regions",
+		Members: []string{"primary-cluster", "secondary-cluster"},
+	}}
+
+	// Both clusters start out online...
+	require.NoError(t, presence.UpsertTunnelConnection(&fakeTunnelConnection{clusterName: "primary-cluster"}))
+	require.NoError(t, presence.UpsertTunnelConnection(&fakeTunnelConnection{clusterName: "secondary-cluster"}))
+	require.True(t, IsTrustedClusterOnline(presence, "primary-cluster"))
+
+	// ...until the primary's tunnel connections are deleted, the actual
+	// failover trigger, e.g. because its proxies stopped dialing back.
+	require.NoError(t, presence.DeleteTunnelConnections("primary-cluster"))
+	require.False(t, IsTrustedClusterOnline(presence, "primary-cluster"))
+
+	var emitted []SamenessGroupFailoverEvent
+	emit := func(ctx context.Context, e SamenessGroupFailoverEvent) { emitted = append(emitted, e) }
+	isOnline := func(clusterName string) bool { return IsTrustedClusterOnline(presence, clusterName) }
+
+	got, err := ResolveSamenessGroupMember(ctx, presence, "prod-regions", isOnline, emit)
+	require.NoError(t, err)
+	require.Equal(t, "secondary-cluster", got)
+	require.Equal(t, []SamenessGroupFailoverEvent{
+		{GroupName: "prod-regions", From: "primary-cluster", To: "secondary-cluster"},
+	}, emitted)
+}
+
+func TestResolveSamenessGroupMemberUnknownGroup(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	presence := &fakeGroupPresence{group: SamenessGroup{Name: "prod-regions", Members: []string{"a", "b"}}}
+	_, err := ResolveSamenessGroupMember(ctx, presence, "nonexistent", func(string) bool { return true }, nil)
+	require.True(t, trace.IsNotFound(err))
+}
+
+func TestValidateSamenessGroupTrustChain(t *testing.T) {
+	t.Parallel()
+
+	group := SamenessGroup{Name: "prod-regions", Members: []string{"us-east", "us-west"}}
+
+	t.Run("matching pins pass", func(t *testing.T) {
+		t.Parallel()
+		err := ValidateSamenessGroupTrustChain(group, func(name string) (string, error) { return "pin-a", nil })
+		require.NoError(t, err)
+	})
+
+	t.Run("mismatched pins fail", func(t *testing.T) {
+		t.Parallel()
+		pins := map[string]string{"us-east": "pin-a", "us-west": "pin-b"}
+		err := ValidateSamenessGroupTrustChain(group, func(name string) (string, error) { return pins[name], nil })
+		require.Error(t, err)
+	})
+}
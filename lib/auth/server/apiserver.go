@@ -0,0 +1,257 @@
+/*
+Copyright 2021 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package server implements the auth API server, the HTTP surface that
+// teleport components speak to the auth service over.
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+
+	"github.com/gravitational/trace"
+	"github.com/julienschmidt/httprouter"
+
+	"github.com/gravitational/teleport"
+	"github.com/gravitational/teleport/api/types"
+	"github.com/gravitational/teleport/lib/auth"
+	"github.com/gravitational/teleport/lib/auth/resource"
+)
+
+// serverBackend is the slice of auth.Presence the APIServer's server
+// registration handlers need. It's declared narrowly, rather than taking a
+// full auth.Presence, so that test doubles only have to implement the
+// handful of methods actually exercised over HTTP here.
+type serverBackend interface {
+	UpsertNode(server types.Server) (*types.KeepAlive, error)
+	UpsertAuthServer(server types.Server) error
+	UpsertProxy(server types.Server) error
+	GetAuthServers() ([]types.Server, error)
+	GetNodes(namespace string, filter auth.ResourceFilter, opts ...auth.MarshalOption) ([]types.Server, error)
+	GetProxies() ([]types.Server, error)
+	GetAppServers(ctx context.Context, namespace string, filter auth.ResourceFilter, opts ...auth.MarshalOption) ([]types.Server, error)
+	GetDatabaseServers(ctx context.Context, namespace string, filter auth.ResourceFilter, opts ...auth.MarshalOption) ([]types.DatabaseServer, error)
+	GetKubeServices(ctx context.Context, filter auth.ResourceFilter) ([]types.Server, error)
+	nodeStreamUpserter
+}
+
+// APIServer implements the auth HTTP API. Routes are registered through GET,
+// POST, PUT and DELETE, each of which wraps the supplied handler with the
+// server's interceptor chain (panic recovery, logging, metrics) before
+// handing it to the underlying router.
+type APIServer struct {
+	router       *httprouter.Router
+	backend      serverBackend
+	interceptors []Interceptor
+}
+
+// NewAPIServer returns an APIServer backed by backend, with the default
+// interceptor chain installed (extended by any options passed in) and every
+// route registered.
+func NewAPIServer(backend serverBackend, opts ...APIOption) *APIServer {
+	s := &APIServer{
+		router:  httprouter.New(),
+		backend: backend,
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+
+	s.POST("upsertNode", "/v1/namespaces/:namespace/nodes", s.makeUpsertServerHandler(teleport.RoleNode))
+	s.POST("upsertProxy", "/v1/proxies", s.makeUpsertServerHandler(teleport.RoleProxy))
+	s.POST("upsertAuthServer", "/v1/authservers", s.makeUpsertServerHandler(teleport.RoleAuth))
+	s.GET("getNodes", "/v1/namespaces/:namespace/nodes", s.getNodes)
+	s.GET("getProxies", "/v1/proxies", s.getProxies)
+	s.GET("getAppServers", "/v1/namespaces/:namespace/appservers", s.getAppServers)
+	s.GET("getDatabaseServers", "/v1/namespaces/:namespace/databaseservers", s.getDatabaseServers)
+	s.GET("getKubeServices", "/v1/kubeservices", s.getKubeServices)
+	s.POST("upsertNodesStream", "/v1/namespaces/:namespace/nodes/stream", s.handleUpsertNodesStream)
+
+	return s
+}
+
+// GET registers handle for GET requests to path, wrapped in the server's
+// interceptor chain.
+func (s *APIServer) GET(name, path string, handle httprouter.Handle) {
+	s.router.GET(path, s.wrapHandler(name, handle))
+}
+
+// POST registers handle for POST requests to path, wrapped in the server's
+// interceptor chain.
+func (s *APIServer) POST(name, path string, handle httprouter.Handle) {
+	s.router.POST(path, s.wrapHandler(name, handle))
+}
+
+// PUT registers handle for PUT requests to path, wrapped in the server's
+// interceptor chain.
+func (s *APIServer) PUT(name, path string, handle httprouter.Handle) {
+	s.router.PUT(path, s.wrapHandler(name, handle))
+}
+
+// DELETE registers handle for DELETE requests to path, wrapped in the
+// server's interceptor chain.
+func (s *APIServer) DELETE(name, path string, handle httprouter.Handle) {
+	s.router.DELETE(path, s.wrapHandler(name, handle))
+}
+
+// ServeHTTP implements http.Handler by delegating to the underlying router.
+func (s *APIServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.router.ServeHTTP(w, r)
+}
+
+// UpsertServerRawReq is the wire format for the upsertNode/upsertProxy/
+// upsertAuthServer endpoints: a single resource, already schema-marshaled,
+// carried as a raw JSON blob so the server can pick the right kind to
+// unmarshal it as based on the caller's role.
+type UpsertServerRawReq struct {
+	Server json.RawMessage `json:"server"`
+}
+
+// message is a minimal JSON-able acknowledgement returned by handlers that
+// have nothing more specific to report.
+type message string
+
+// makeUpsertServerHandler binds upsertServer to a fixed role, since each
+// registered route only ever serves callers presenting one role (a node
+// connects to the node route, a proxy to the proxy route, and so on).
+func (s *APIServer) makeUpsertServerHandler(role teleport.Role) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		result, err := s.upsertServer(s.backend, role, r, p)
+		if err != nil {
+			trace.WriteError(w, err)
+			return
+		}
+		roundtrip(w, result)
+	}
+}
+
+// upsertServer decodes a single server record from r and upserts it into
+// backend as the resource kind implied by role, rejecting roles that aren't
+// allowed to register server presence.
+func (s *APIServer) upsertServer(backend serverBackend, role teleport.Role, r *http.Request, p httprouter.Params) (interface{}, error) {
+	var req UpsertServerRawReq
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return nil, trace.Wrap(err)
+	}
+
+	var kind string
+	switch role {
+	case teleport.RoleNode:
+		kind = types.KindNode
+	case teleport.RoleProxy:
+		kind = types.KindProxy
+	case teleport.RoleAuth:
+		kind = types.KindAuthServer
+	default:
+		return nil, trace.AccessDenied("role %q is not permitted to register server presence", role)
+	}
+
+	server, err := resource.UnmarshalServer(req.Server, kind)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+
+	switch role {
+	case teleport.RoleNode:
+		keepAlive, err := backend.UpsertNode(server)
+		if err != nil {
+			return nil, trace.Wrap(err)
+		}
+		return keepAlive, nil
+	case teleport.RoleProxy:
+		if err := backend.UpsertProxy(server); err != nil {
+			return nil, trace.Wrap(err)
+		}
+	case teleport.RoleAuth:
+		if err := backend.UpsertAuthServer(server); err != nil {
+			return nil, trace.Wrap(err)
+		}
+	}
+	return message("ok"), nil
+}
+
+// getNodes serves the node listing REST endpoint, parsing any label,
+// search or predicate query parameters into an auth.ResourceFilter so that
+// matching is pushed down to the backend instead of happening client-side.
+func (s *APIServer) getNodes(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	filter := resourceFilterFromURL(r)
+	nodes, err := s.backend.GetNodes(p.ByName("namespace"), filter)
+	if err != nil {
+		trace.WriteError(w, err)
+		return
+	}
+	roundtrip(w, nodes)
+}
+
+// getProxies serves the proxy listing REST endpoint. types.ProxyGetter (the
+// interface GetProxies comes from) predates ResourceFilter and has no
+// filter parameter of its own, so filtering happens here, after the
+// backend call, rather than being pushed down into the backend/cache layer
+// the way getNodes's filtering is.
+func (s *APIServer) getProxies(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	proxies, err := s.backend.GetProxies()
+	if err != nil {
+		trace.WriteError(w, err)
+		return
+	}
+	filtered, err := auth.ApplyServerFilter(proxies, resourceFilterFromURL(r))
+	if err != nil {
+		trace.WriteError(w, err)
+		return
+	}
+	roundtrip(w, filtered)
+}
+
+// getAppServers serves the application server listing REST endpoint,
+// parsing the same label/search/predicate query parameters as getNodes and
+// pushing the resulting filter down into the backend call.
+func (s *APIServer) getAppServers(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	servers, err := s.backend.GetAppServers(r.Context(), p.ByName("namespace"), resourceFilterFromURL(r))
+	if err != nil {
+		trace.WriteError(w, err)
+		return
+	}
+	roundtrip(w, servers)
+}
+
+// getDatabaseServers serves the database proxy server listing REST
+// endpoint; see getAppServers.
+func (s *APIServer) getDatabaseServers(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	servers, err := s.backend.GetDatabaseServers(r.Context(), p.ByName("namespace"), resourceFilterFromURL(r))
+	if err != nil {
+		trace.WriteError(w, err)
+		return
+	}
+	roundtrip(w, servers)
+}
+
+// getKubeServices serves the kubernetes service listing REST endpoint.
+// Kubernetes services aren't namespaced the way nodes/app servers/database
+// servers are, so unlike those there's no :namespace path parameter here.
+func (s *APIServer) getKubeServices(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	servers, err := s.backend.GetKubeServices(r.Context(), resourceFilterFromURL(r))
+	if err != nil {
+		trace.WriteError(w, err)
+		return
+	}
+	roundtrip(w, servers)
+}
+
+func roundtrip(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(v)
+}
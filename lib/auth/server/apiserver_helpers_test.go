@@ -0,0 +1,202 @@
+/*
+Copyright 2021 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"context"
+	"sync"
+	"testing"
+
+	"github.com/gravitational/trace"
+
+	"github.com/gravitational/teleport/api/types"
+	"github.com/gravitational/teleport/lib/auth"
+)
+
+// testServices is a minimal in-memory serverBackend used by this package's
+// tests in place of a real backend-backed Presence implementation.
+type testServices struct {
+	mu         sync.Mutex
+	nodes      map[string]types.Server
+	proxies    map[string]types.Server
+	auths      map[string]types.Server
+	appServers map[string]types.Server
+	dbServers  map[string]types.DatabaseServer
+	kubeSvcs   map[string]types.Server
+}
+
+func newTestServices(t *testing.T) *testServices {
+	t.Helper()
+	return &testServices{
+		nodes:      make(map[string]types.Server),
+		proxies:    make(map[string]types.Server),
+		auths:      make(map[string]types.Server),
+		appServers: make(map[string]types.Server),
+		dbServers:  make(map[string]types.DatabaseServer),
+		kubeSvcs:   make(map[string]types.Server),
+	}
+}
+
+func (s *testServices) UpsertNode(server types.Server) (*types.KeepAlive, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.nodes[server.GetName()] = server
+	return nil, nil
+}
+
+func (s *testServices) UpsertAuthServer(server types.Server) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.auths[server.GetName()] = server
+	return nil
+}
+
+func (s *testServices) UpsertProxy(server types.Server) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.proxies[server.GetName()] = server
+	return nil
+}
+
+func (s *testServices) GetAuthServers() ([]types.Server, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return mapValues(s.auths), nil
+}
+
+func (s *testServices) GetProxies() ([]types.Server, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return mapValues(s.proxies), nil
+}
+
+// GetNodes returns every node in namespace matching filter, evaluated
+// against each node before it's added to the result set so that (as in a
+// real backend-cache implementation) non-matching records are never
+// decoded into the response.
+func (s *testServices) GetNodes(namespace string, filter auth.ResourceFilter, opts ...auth.MarshalOption) ([]types.Server, error) {
+	if _, err := auth.CollectOptions(opts); err != nil {
+		return nil, trace.Wrap(err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var inNamespace []types.Server
+	for _, node := range s.nodes {
+		if node.GetNamespace() == namespace {
+			inNamespace = append(inNamespace, node)
+		}
+	}
+	return auth.ApplyServerFilter(inNamespace, filter)
+}
+
+// GetAppServers returns every application server in namespace matching
+// filter; see GetNodes.
+func (s *testServices) GetAppServers(ctx context.Context, namespace string, filter auth.ResourceFilter, opts ...auth.MarshalOption) ([]types.Server, error) {
+	if _, err := auth.CollectOptions(opts); err != nil {
+		return nil, trace.Wrap(err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var inNamespace []types.Server
+	for _, server := range s.appServers {
+		if server.GetNamespace() == namespace {
+			inNamespace = append(inNamespace, server)
+		}
+	}
+	return auth.ApplyServerFilter(inNamespace, filter)
+}
+
+// addAppServer seeds server into the backend for tests; there is no
+// UpsertAppServer in serverBackend to exercise over HTTP here.
+func (s *testServices) addAppServer(server types.Server) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.appServers[server.GetName()] = server
+}
+
+// GetDatabaseServers returns every database server in namespace matching
+// filter; see GetNodes.
+func (s *testServices) GetDatabaseServers(ctx context.Context, namespace string, filter auth.ResourceFilter, opts ...auth.MarshalOption) ([]types.DatabaseServer, error) {
+	if _, err := auth.CollectOptions(opts); err != nil {
+		return nil, trace.Wrap(err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var inNamespace []types.DatabaseServer
+	for _, server := range s.dbServers {
+		if server.GetNamespace() == namespace {
+			inNamespace = append(inNamespace, server)
+		}
+	}
+	return auth.ApplyDatabaseServerFilter(inNamespace, filter)
+}
+
+// addDatabaseServer seeds server into the backend for tests; there is no
+// UpsertDatabaseServer in serverBackend to exercise over HTTP here.
+func (s *testServices) addDatabaseServer(server types.DatabaseServer) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.dbServers[server.GetName()] = server
+}
+
+// GetKubeServices returns every registered kubernetes service matching
+// filter; unlike GetNodes/GetAppServers there's no namespace to scope by.
+func (s *testServices) GetKubeServices(ctx context.Context, filter auth.ResourceFilter) ([]types.Server, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return auth.ApplyServerFilter(mapValues(s.kubeSvcs), filter)
+}
+
+// addKubeService seeds service into the backend for tests; there is no
+// UpsertKubeService in serverBackend to exercise over HTTP here.
+func (s *testServices) addKubeService(service types.Server) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.kubeSvcs[service.GetName()] = service
+}
+
+// UpsertNodesStream delegates to auth.StreamUpsertNodes so the handler can
+// be exercised end-to-end against this in-memory backend instead of only
+// against the narrower fakeStreamBackend in upsert_nodes_stream_test.go.
+func (s *testServices) UpsertNodesStream(ctx context.Context, namespace string, nodes <-chan types.Server, opts ...auth.StreamOption) (<-chan auth.UpsertResult, error) {
+	upsert := func(ctx context.Context, namespace string, batch []types.Server) error {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		for _, node := range batch {
+			s.nodes[node.GetName()] = node
+		}
+		return nil
+	}
+	validate := func(server types.Server) error {
+		return nil
+	}
+	return auth.StreamUpsertNodes(ctx, namespace, nodes, upsert, validate, opts...), nil
+}
+
+func mapValues(m map[string]types.Server) []types.Server {
+	out := make([]types.Server, 0, len(m))
+	for _, v := range m {
+		out = append(out, v)
+	}
+	return out
+}
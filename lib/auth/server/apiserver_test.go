@@ -25,6 +25,7 @@ import (
 
 	"github.com/gravitational/teleport"
 	"github.com/gravitational/teleport/api/types"
+	"github.com/gravitational/teleport/lib/auth"
 	"github.com/gravitational/teleport/lib/auth/resource"
 	"github.com/gravitational/teleport/lib/defaults"
 
@@ -128,9 +129,160 @@ func TestUpsertServer(t *testing.T) {
 				allServers = append(allServers, servers...)
 			}
 			addServers(s.GetAuthServers())
-			addServers(s.GetNodes(defaults.Namespace))
+			addServers(s.GetNodes(defaults.Namespace, auth.ResourceFilter{}))
 			addServers(s.GetProxies())
 			require.Empty(t, cmp.Diff(allServers, []types.Server{tt.wantServer}))
 		})
 	}
 }
+
+// TestGetNodesFiltering verifies that the getNodes REST endpoint parses its
+// query string into a filter and that only matching nodes are returned,
+// i.e. that filtering happens server-side rather than requiring the caller
+// to fetch every node and filter client-side.
+func TestGetNodesFiltering(t *testing.T) {
+	t.Parallel()
+
+	backend := newTestServices(t)
+	_, err := backend.UpsertNode(&types.ServerV2{
+		Metadata: types.Metadata{Name: "prod-1", Namespace: defaults.Namespace, Labels: map[string]string{"env": "prod"}},
+		Version:  types.V2,
+		Kind:     types.KindNode,
+	})
+	require.NoError(t, err)
+	_, err = backend.UpsertNode(&types.ServerV2{
+		Metadata: types.Metadata{Name: "staging-1", Namespace: defaults.Namespace, Labels: map[string]string{"env": "staging"}},
+		Version:  types.V2,
+		Kind:     types.KindNode,
+	})
+	require.NoError(t, err)
+
+	s := NewAPIServer(backend)
+
+	req := httptest.NewRequest(http.MethodGet, "http://localhost/v1/namespaces/"+defaults.Namespace+"/nodes?labels=env=prod", nil)
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, req)
+	require.Equal(t, http.StatusOK, rec.Code)
+
+	var nodes []types.ServerV2
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(&nodes))
+	require.Len(t, nodes, 1)
+	require.Equal(t, "prod-1", nodes[0].GetName())
+}
+
+// TestGetAppServersFiltering verifies that the getAppServers REST endpoint
+// pushes its query-string filter down into the backend call, same as
+// getNodes.
+func TestGetAppServersFiltering(t *testing.T) {
+	t.Parallel()
+
+	backend := newTestServices(t)
+	backend.addAppServer(&types.ServerV2{
+		Metadata: types.Metadata{Name: "app-prod", Namespace: defaults.Namespace, Labels: map[string]string{"env": "prod"}},
+		Version:  types.V2,
+		Kind:     types.KindAppServer,
+	})
+	backend.addAppServer(&types.ServerV2{
+		Metadata: types.Metadata{Name: "app-staging", Namespace: defaults.Namespace, Labels: map[string]string{"env": "staging"}},
+		Version:  types.V2,
+		Kind:     types.KindAppServer,
+	})
+
+	s := NewAPIServer(backend)
+
+	req := httptest.NewRequest(http.MethodGet, "http://localhost/v1/namespaces/"+defaults.Namespace+"/appservers?labels=env=prod", nil)
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, req)
+	require.Equal(t, http.StatusOK, rec.Code)
+
+	var servers []types.ServerV2
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(&servers))
+	require.Len(t, servers, 1)
+	require.Equal(t, "app-prod", servers[0].GetName())
+}
+
+// TestGetDatabaseServersFiltering verifies the getDatabaseServers REST
+// endpoint's filter push-down.
+func TestGetDatabaseServersFiltering(t *testing.T) {
+	t.Parallel()
+
+	backend := newTestServices(t)
+	backend.addDatabaseServer(&types.DatabaseServerV3{
+		Metadata: types.Metadata{Name: "db-prod", Namespace: defaults.Namespace, Labels: map[string]string{"env": "prod"}},
+		Version:  types.V3,
+		Kind:     types.KindDatabaseServer,
+	})
+	backend.addDatabaseServer(&types.DatabaseServerV3{
+		Metadata: types.Metadata{Name: "db-staging", Namespace: defaults.Namespace, Labels: map[string]string{"env": "staging"}},
+		Version:  types.V3,
+		Kind:     types.KindDatabaseServer,
+	})
+
+	s := NewAPIServer(backend)
+
+	req := httptest.NewRequest(http.MethodGet, "http://localhost/v1/namespaces/"+defaults.Namespace+"/databaseservers?labels=env=prod", nil)
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, req)
+	require.Equal(t, http.StatusOK, rec.Code)
+
+	var servers []types.DatabaseServerV3
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(&servers))
+	require.Len(t, servers, 1)
+	require.Equal(t, "db-prod", servers[0].GetName())
+}
+
+// TestGetKubeServicesFiltering verifies the getKubeServices REST endpoint's
+// filter push-down. Unlike the namespaced listings above, this endpoint
+// takes no :namespace path parameter.
+func TestGetKubeServicesFiltering(t *testing.T) {
+	t.Parallel()
+
+	backend := newTestServices(t)
+	backend.addKubeService(&types.ServerV2{
+		Metadata: types.Metadata{Name: "kube-prod", Namespace: defaults.Namespace, Labels: map[string]string{"env": "prod"}},
+		Version:  types.V2,
+		Kind:     types.KindKubeService,
+	})
+	backend.addKubeService(&types.ServerV2{
+		Metadata: types.Metadata{Name: "kube-staging", Namespace: defaults.Namespace, Labels: map[string]string{"env": "staging"}},
+		Version:  types.V2,
+		Kind:     types.KindKubeService,
+	})
+
+	s := NewAPIServer(backend)
+
+	req := httptest.NewRequest(http.MethodGet, "http://localhost/v1/kubeservices?labels=env=prod", nil)
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, req)
+	require.Equal(t, http.StatusOK, rec.Code)
+
+	var servers []types.ServerV2
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(&servers))
+	require.Len(t, servers, 1)
+	require.Equal(t, "kube-prod", servers[0].GetName())
+}
+
+// TestAPIServerPanicRecovery verifies that a handler panic is recovered by
+// the default interceptor chain and turned into a well-formed error
+// response instead of crashing the process.
+func TestAPIServerPanicRecovery(t *testing.T) {
+	t.Parallel()
+
+	// NewAPIServer already registers nine routes through the interceptor
+	// chain, and the panicking route here is one more, so this also
+	// exercises that the shared Metrics collector tolerates more than one
+	// route (see Metrics for the duplicate-registration problem it avoids).
+	s := NewAPIServer(newTestServices(t))
+	s.GET("panicHandler", "/panic", func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		panic("boom")
+	})
+
+	req := httptest.NewRequest(http.MethodGet, "http://localhost/panic", nil)
+	req.RemoteAddr = "test-remote-addr"
+	rec := httptest.NewRecorder()
+
+	require.NotPanics(t, func() {
+		s.ServeHTTP(rec, req)
+	})
+	require.NotEqual(t, http.StatusOK, rec.Code)
+}
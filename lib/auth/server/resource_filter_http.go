@@ -0,0 +1,57 @@
+/*
+Copyright 2021 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/gravitational/teleport/lib/auth"
+)
+
+// resourceFilterFromURL builds an auth.ResourceFilter out of a request's
+// query parameters, so that REST listing endpoints (getNodes and friends)
+// can push filtering down to the backend instead of every caller fetching
+// the full list and filtering client-side. Recognized parameters:
+//
+//	labels=env=prod,team=core   (comma-separated key=value pairs)
+//	search=foo&search=bar       (repeatable; every term must match)
+//	query=labels["env"] == "prod"  (a ResourceFilter.PredicateExpression)
+func resourceFilterFromURL(r *http.Request) auth.ResourceFilter {
+	q := r.URL.Query()
+
+	var filter auth.ResourceFilter
+
+	if labels := q.Get("labels"); labels != "" {
+		filter.Labels = make(map[string]string)
+		for _, pair := range strings.Split(labels, ",") {
+			kv := strings.SplitN(pair, "=", 2)
+			if len(kv) != 2 || kv[0] == "" {
+				continue
+			}
+			filter.Labels[kv[0]] = kv[1]
+		}
+	}
+
+	if search, ok := q["search"]; ok {
+		filter.SearchKeywords = search
+	}
+
+	filter.PredicateExpression = q.Get("query")
+
+	return filter
+}
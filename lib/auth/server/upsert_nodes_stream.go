@@ -0,0 +1,128 @@
+/*
+Copyright 2021 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+
+	"github.com/gravitational/trace"
+	"github.com/julienschmidt/httprouter"
+
+	"github.com/gravitational/teleport/api/types"
+	"github.com/gravitational/teleport/lib/auth"
+	"github.com/gravitational/teleport/lib/auth/resource"
+)
+
+// nodeStreamUpserter is the slice of auth.Presence that upsertNodesStream
+// needs; it's declared narrowly so tests can exercise the handler against a
+// fake backend without implementing the rest of Presence.
+type nodeStreamUpserter interface {
+	UpsertNodesStream(ctx context.Context, namespace string, nodes <-chan types.Server, opts ...auth.StreamOption) (<-chan auth.UpsertResult, error)
+}
+
+// upsertNodesStreamLineLimit bounds how large a single newline-delimited
+// JSON record in the request body may be.
+const upsertNodesStreamLineLimit = 64 * 1024
+
+// streamResultIndexAborted is the sentinel UpsertResult.Index value used
+// for the stream-level error line described on handleUpsertNodesStream.
+const streamResultIndexAborted = -1
+
+func (s *APIServer) handleUpsertNodesStream(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	if err := s.upsertNodesStream(s.backend, r, p, w); err != nil {
+		trace.WriteError(w, err)
+	}
+}
+
+// upsertNodesStream handles the chunked bulk-import endpoint: the request
+// body is newline-delimited JSON server records, and the response body is
+// newline-delimited JSON auth.UpsertResult records, written as each node is
+// processed rather than buffered until the whole import completes.
+//
+// Because results are streamed as they're produced, the response status is
+// committed to 200 before the last record is known to have succeeded. A
+// request body that can't be parsed (malformed JSON, a line over
+// upsertNodesStreamLineLimit) therefore can't be reported as a 4xx/5xx once
+// streaming has started; instead it is reported in-band as one final
+// UpsertResult with Index == streamResultIndexAborted and Accepted ==
+// false, so callers must check for that sentinel in addition to per-record
+// Accepted fields. Failures that happen before any bytes are written
+// (missing namespace, backend.UpsertNodesStream itself failing) are still
+// reported as a normal error response.
+func (s *APIServer) upsertNodesStream(backend nodeStreamUpserter, r *http.Request, p httprouter.Params, w http.ResponseWriter) error {
+	namespace := p.ByName("namespace")
+	if namespace == "" {
+		return trace.BadParameter("missing namespace")
+	}
+
+	nodes := make(chan types.Server)
+	scanErrs := make(chan error, 1)
+
+	go func() {
+		defer close(nodes)
+		scanner := bufio.NewScanner(r.Body)
+		scanner.Buffer(make([]byte, 0, 4096), upsertNodesStreamLineLimit)
+		for scanner.Scan() {
+			line := scanner.Bytes()
+			if len(line) == 0 {
+				continue
+			}
+			server, err := resource.UnmarshalServer(line, types.KindNode)
+			if err != nil {
+				scanErrs <- trace.Wrap(err)
+				return
+			}
+			select {
+			case nodes <- server:
+			case <-r.Context().Done():
+				scanErrs <- r.Context().Err()
+				return
+			}
+		}
+		scanErrs <- scanner.Err()
+	}()
+
+	results, err := backend.UpsertNodesStream(r.Context(), namespace, nodes)
+	if err != nil {
+		return trace.Wrap(err)
+	}
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+	flusher, canFlush := w.(http.Flusher)
+
+	enc := json.NewEncoder(w)
+	for result := range results {
+		if err := enc.Encode(result); err != nil {
+			return trace.Wrap(err)
+		}
+		if canFlush {
+			flusher.Flush()
+		}
+	}
+
+	if err := <-scanErrs; err != nil {
+		_ = enc.Encode(auth.UpsertResult{Index: streamResultIndexAborted, Accepted: false, Error: err.Error()})
+		if canFlush {
+			flusher.Flush()
+		}
+	}
+	return nil
+}
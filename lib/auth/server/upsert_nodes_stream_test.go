@@ -0,0 +1,156 @@
+/*
+Copyright 2021 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/gravitational/trace"
+	"github.com/julienschmidt/httprouter"
+	"github.com/stretchr/testify/require"
+
+	"github.com/gravitational/teleport/api/types"
+	"github.com/gravitational/teleport/lib/auth"
+	"github.com/gravitational/teleport/lib/defaults"
+)
+
+// fakeStreamBackend feeds StreamUpsertNodes with an in-memory upserter so
+// the handler can be exercised without a real Presence backend.
+type fakeStreamBackend struct {
+	rejectNames map[string]bool
+}
+
+func (f *fakeStreamBackend) UpsertNodesStream(ctx context.Context, namespace string, nodes <-chan types.Server, opts ...auth.StreamOption) (<-chan auth.UpsertResult, error) {
+	upsert := func(ctx context.Context, namespace string, batch []types.Server) error {
+		return nil
+	}
+	validate := func(s types.Server) error {
+		if f.rejectNames[s.GetName()] {
+			return trace.BadParameter("rejected by test validator")
+		}
+		return nil
+	}
+	return auth.StreamUpsertNodes(ctx, namespace, nodes, upsert, validate, opts...), nil
+}
+
+func TestUpsertNodesStream(t *testing.T) {
+	t.Parallel()
+
+	backend := &fakeStreamBackend{rejectNames: map[string]bool{"bad-node": true}}
+
+	var body bytes.Buffer
+	for _, name := range []string{"node-1", "bad-node", "node-2"} {
+		raw, err := json.Marshal(&types.ServerV2{
+			Metadata: types.Metadata{Name: name, Namespace: defaults.Namespace},
+			Version:  types.V2,
+			Kind:     types.KindNode,
+		})
+		require.NoError(t, err)
+		body.Write(raw)
+		body.WriteByte('\n')
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "http://localhost", &body)
+	rec := httptest.NewRecorder()
+	params := httprouter.Params{httprouter.Param{Key: "namespace", Value: defaults.Namespace}}
+
+	// upsertNodesStream only uses the backend passed in explicitly, not
+	// s.backend, so the fakeStreamBackend above (which implements just
+	// nodeStreamUpserter, not the full serverBackend) can stand in for it
+	// here; the APIServer itself just needs to exist to provide a receiver.
+	s := NewAPIServer(newTestServices(t))
+	err := s.upsertNodesStream(backend, req, params, rec)
+	require.NoError(t, err)
+
+	dec := json.NewDecoder(rec.Body)
+	var results []auth.UpsertResult
+	for {
+		var r auth.UpsertResult
+		if decErr := dec.Decode(&r); decErr != nil {
+			break
+		}
+		results = append(results, r)
+	}
+
+	// A record rejected by validation is reported as soon as it is read,
+	// ahead of the valid records still waiting in the current batch, so
+	// results are put back into input order by Index before checking them.
+	sort.Slice(results, func(i, j int) bool { return results[i].Index < results[j].Index })
+
+	require.Len(t, results, 3)
+	require.True(t, results[0].Accepted)
+	require.False(t, results[1].Accepted)
+	require.True(t, results[2].Accepted)
+}
+
+// stallingStreamBackend never drains the nodes channel it's handed, so a
+// scanned line's send on it blocks until the request context is cancelled;
+// it's used to drive upsertNodesStream's scanner goroutine down the
+// r.Context().Done() path instead of the scanner-error or EOF paths.
+type stallingStreamBackend struct{}
+
+func (stallingStreamBackend) UpsertNodesStream(ctx context.Context, namespace string, nodes <-chan types.Server, opts ...auth.StreamOption) (<-chan auth.UpsertResult, error) {
+	results := make(chan auth.UpsertResult)
+	go func() {
+		<-ctx.Done()
+		close(results)
+	}()
+	return results, nil
+}
+
+// TestUpsertNodesStreamDoesNotHangOnClientDisconnect guards against a
+// deadlock: if the scanner goroutine returns on context cancellation
+// without ever signaling scanErrs, the final `<-scanErrs` read in
+// upsertNodesStream blocks forever.
+func TestUpsertNodesStreamDoesNotHangOnClientDisconnect(t *testing.T) {
+	t.Parallel()
+
+	raw, err := json.Marshal(&types.ServerV2{
+		Metadata: types.Metadata{Name: "node-1", Namespace: defaults.Namespace},
+		Version:  types.V2,
+		Kind:     types.KindNode,
+	})
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	req := httptest.NewRequest(http.MethodPost, "http://localhost", bytes.NewReader(append(raw, '\n'))).WithContext(ctx)
+	rec := httptest.NewRecorder()
+	params := httprouter.Params{httprouter.Param{Key: "namespace", Value: defaults.Namespace}}
+
+	s := NewAPIServer(newTestServices(t))
+
+	done := make(chan error, 1)
+	go func() {
+		done <- s.upsertNodesStream(stallingStreamBackend{}, req, params, rec)
+	}()
+
+	cancel()
+
+	select {
+	case err := <-done:
+		require.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("upsertNodesStream hung after the client disconnected")
+	}
+}
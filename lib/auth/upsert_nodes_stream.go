@@ -0,0 +1,170 @@
+/*
+Copyright 2021 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package auth
+
+import (
+	"context"
+
+	"github.com/gravitational/teleport/api/types"
+)
+
+// defaultStreamBatchSize matches the batch size UpsertNodesStream uses when
+// StreamWithBatchSize isn't passed.
+const defaultStreamBatchSize = 500
+
+// UpsertResult reports the outcome of upserting a single node submitted
+// through a streaming bulk import (UpsertNodesStream or the chunked HTTP
+// endpoint built on top of it).
+type UpsertResult struct {
+	// Name is the node's name, taken from the submitted record.
+	Name string
+	// Index is the record's 0-based position in the input stream.
+	Index int
+	// Accepted is true if the node was validated and written successfully.
+	Accepted bool
+	// Error describes why the node was rejected, empty when Accepted.
+	Error string
+}
+
+// streamOptions configures UpsertNodesStream.
+type streamOptions struct {
+	batchSize    int
+	abortOnError bool
+}
+
+// StreamOption configures UpsertNodesStream.
+type StreamOption func(*streamOptions)
+
+// StreamWithBatchSize overrides the default batch size (500) used to group
+// incoming nodes before writing them to the backend.
+func StreamWithBatchSize(n int) StreamOption {
+	return func(o *streamOptions) {
+		if n > 0 {
+			o.batchSize = n
+		}
+	}
+}
+
+// StreamAbortOnError switches UpsertNodesStream from its default
+// continue-on-error mode, where a failed batch doesn't stop later batches
+// from being attempted, to abort-on-error, where the stream stops reading
+// further input as soon as a batch fails.
+func StreamAbortOnError() StreamOption {
+	return func(o *streamOptions) {
+		o.abortOnError = true
+	}
+}
+
+// BatchUpserter writes a batch of validated nodes to the backend, mirroring
+// the semantics of Presence.UpsertNodes: either the whole batch succeeds, or
+// it returns an error describing why it didn't.
+type BatchUpserter func(ctx context.Context, namespace string, batch []types.Server) error
+
+// validateNode is the per-record check applied before a node is admitted
+// into a batch; it mirrors the schema validation resource.MarshalServer
+// performs for the non-streaming upsertServer handler.
+type validateNode func(types.Server) error
+
+// StreamUpsertNodes validates and upserts nodes read from the input channel
+// in batches (default size 500, see StreamWithBatchSize), returning a
+// result per node on the returned channel. It is meant for bulk imports of
+// large (10k+) node fleets, where a single malformed record shouldn't
+// reject the whole import and the caller needs incremental progress
+// feedback rather than one final error.
+//
+// In the default continue-on-error mode a failed batch does not stop later
+// batches from being attempted; pass StreamAbortOnError to stop reading
+// further input as soon as a batch fails. Because nodes are only read from
+// the input channel as fast as upsert batches complete, a slow backend
+// naturally applies backpressure to the producer instead of needing a
+// separate flow-control mechanism.
+func StreamUpsertNodes(ctx context.Context, namespace string, nodes <-chan types.Server, upsert BatchUpserter, validate validateNode, opts ...StreamOption) <-chan UpsertResult {
+	o := streamOptions{batchSize: defaultStreamBatchSize}
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	results := make(chan UpsertResult, o.batchSize)
+
+	go func() {
+		defer close(results)
+
+		type pending struct {
+			index  int
+			server types.Server
+		}
+		batch := make([]pending, 0, o.batchSize)
+
+		flush := func() bool {
+			if len(batch) == 0 {
+				return true
+			}
+			servers := make([]types.Server, len(batch))
+			for i, p := range batch {
+				servers[i] = p.server
+			}
+			err := upsert(ctx, namespace, servers)
+			for _, p := range batch {
+				res := UpsertResult{Name: p.server.GetName(), Index: p.index, Accepted: err == nil}
+				if err != nil {
+					res.Error = err.Error()
+				}
+				select {
+				case results <- res:
+				case <-ctx.Done():
+					return false
+				}
+			}
+			batch = batch[:0]
+			return err == nil || !o.abortOnError
+		}
+
+		index := 0
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case server, ok := <-nodes:
+				if !ok {
+					flush()
+					return
+				}
+
+				if err := validate(server); err != nil {
+					select {
+					case results <- UpsertResult{Name: server.GetName(), Index: index, Error: err.Error()}:
+					case <-ctx.Done():
+						return
+					}
+					index++
+					continue
+				}
+
+				batch = append(batch, pending{index: index, server: server})
+				index++
+
+				if len(batch) >= o.batchSize {
+					if !flush() {
+						return
+					}
+				}
+			}
+		}
+	}()
+
+	return results
+}
@@ -0,0 +1,168 @@
+/*
+Copyright 2021 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package auth
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/gravitational/trace"
+	"github.com/stretchr/testify/require"
+
+	"github.com/gravitational/teleport/api/types"
+)
+
+func drainResults(t *testing.T, results <-chan UpsertResult) []UpsertResult {
+	t.Helper()
+	var out []UpsertResult
+	for {
+		select {
+		case r, ok := <-results:
+			if !ok {
+				return out
+			}
+			out = append(out, r)
+		case <-time.After(time.Second):
+			t.Fatal("timed out waiting for stream results")
+		}
+	}
+}
+
+func newTestServer(name string) types.Server {
+	return &types.ServerV2{
+		Metadata: types.Metadata{Name: name},
+		Version:  types.V2,
+		Kind:     types.KindNode,
+	}
+}
+
+func alwaysValid(types.Server) error { return nil }
+
+func TestStreamUpsertNodesAllValid(t *testing.T) {
+	t.Parallel()
+
+	nodes := make(chan types.Server)
+	go func() {
+		defer close(nodes)
+		for _, name := range []string{"n1", "n2", "n3"} {
+			nodes <- newTestServer(name)
+		}
+	}()
+
+	var batches [][]string
+	upsert := func(ctx context.Context, namespace string, batch []types.Server) error {
+		var names []string
+		for _, s := range batch {
+			names = append(names, s.GetName())
+		}
+		batches = append(batches, names)
+		return nil
+	}
+
+	results := drainResults(t, StreamUpsertNodes(context.Background(), "default", nodes, upsert, alwaysValid, StreamWithBatchSize(2)))
+
+	require.Len(t, results, 3)
+	for _, r := range results {
+		require.True(t, r.Accepted)
+		require.Empty(t, r.Error)
+	}
+	// batch size 2 over 3 nodes -> batches of 2 and 1
+	require.Equal(t, [][]string{{"n1", "n2"}, {"n3"}}, batches)
+}
+
+func TestStreamUpsertNodesContinuesPastBadBatch(t *testing.T) {
+	t.Parallel()
+
+	nodes := make(chan types.Server)
+	go func() {
+		defer close(nodes)
+		for _, name := range []string{"bad-1", "bad-2", "good-1"} {
+			nodes <- newTestServer(name)
+		}
+	}()
+
+	upsert := func(ctx context.Context, namespace string, batch []types.Server) error {
+		for _, s := range batch {
+			if s.GetName() == "bad-1" {
+				return trace.BadParameter("rejected batch")
+			}
+		}
+		return nil
+	}
+
+	results := drainResults(t, StreamUpsertNodes(context.Background(), "default", nodes, upsert, alwaysValid, StreamWithBatchSize(2)))
+
+	require.Len(t, results, 3)
+	require.False(t, results[0].Accepted)
+	require.False(t, results[1].Accepted)
+	require.True(t, results[2].Accepted)
+}
+
+func TestStreamUpsertNodesAbortOnError(t *testing.T) {
+	t.Parallel()
+
+	nodes := make(chan types.Server, 4)
+	nodes <- newTestServer("bad-1")
+	nodes <- newTestServer("bad-2")
+	nodes <- newTestServer("never-attempted")
+	close(nodes)
+
+	upsert := func(ctx context.Context, namespace string, batch []types.Server) error {
+		return trace.BadParameter("backend unavailable")
+	}
+
+	results := drainResults(t, StreamUpsertNodes(context.Background(), "default", nodes, upsert, alwaysValid, StreamWithBatchSize(2), StreamAbortOnError()))
+
+	// Only the first batch (bad-1, bad-2) is attempted before the stream
+	// aborts; "never-attempted" is never read off the channel.
+	require.Len(t, results, 2)
+	for _, r := range results {
+		require.False(t, r.Accepted)
+	}
+}
+
+func TestStreamUpsertNodesSkipsInvalidRecords(t *testing.T) {
+	t.Parallel()
+
+	nodes := make(chan types.Server, 2)
+	nodes <- newTestServer("")
+	nodes <- newTestServer("valid")
+	close(nodes)
+
+	validate := func(s types.Server) error {
+		if s.GetName() == "" {
+			return trace.BadParameter("name is required")
+		}
+		return nil
+	}
+
+	var upserted []string
+	upsert := func(ctx context.Context, namespace string, batch []types.Server) error {
+		for _, s := range batch {
+			upserted = append(upserted, s.GetName())
+		}
+		return nil
+	}
+
+	results := drainResults(t, StreamUpsertNodes(context.Background(), "default", nodes, upsert, validate, StreamWithBatchSize(10)))
+
+	require.Len(t, results, 2)
+	require.False(t, results[0].Accepted)
+	require.True(t, results[1].Accepted)
+	require.Equal(t, []string{"valid"}, upserted)
+}
@@ -0,0 +1,495 @@
+/*
+Copyright 2021 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package session
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gravitational/trace"
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+)
+
+// EventType identifies the kind of session lifecycle event being teed out
+// to a Recorder sink.
+type EventType string
+
+const (
+	// EventSessionCreated fires from CreateSession.
+	EventSessionCreated EventType = "session.created"
+	// EventSessionUpdated fires from UpdateSession.
+	EventSessionUpdated EventType = "session.updated"
+	// EventSessionDeleted fires from DeleteSession.
+	EventSessionDeleted EventType = "session.deleted"
+	// EventPartyJoined fires when a party joins a session.
+	EventPartyJoined EventType = "party.joined"
+	// EventPartyLeft fires when a party leaves a session.
+	EventPartyLeft EventType = "party.left"
+)
+
+// SinkEvent is a single session lifecycle event fanned out to every
+// configured Recorder. Data carries the event-specific payload (the
+// Session, UpdateRequest or Party involved).
+type SinkEvent struct {
+	Type      EventType
+	Namespace string
+	SessionID string
+	Data      interface{}
+}
+
+// Recorder is a pluggable sink that tees session lifecycle events out of
+// the local backend and into an external system (Kafka, S3, a webhook,
+// ...). Implementations must not block the caller of Record for long; Record
+// is only ever called from the sink's own worker goroutine, but a Recorder
+// that blocks indefinitely will still back up that sink's queue.
+type Recorder interface {
+	// Name identifies the sink, used in metrics and logs.
+	Name() string
+	// Record delivers a single event to the sink. The caller (sinkWorker)
+	// retries a failing Record indefinitely, with capped backoff, until it
+	// succeeds or the context the worker was started with is done; closing
+	// the worker does not stop the retries. Delivery is at-least-once for
+	// any event that made it into the queue, unless that context is done
+	// first: then the event being retried and any still queued are not
+	// delivered. The other way to lose an event is for the queue itself to
+	// be full when Fanout is called (see sinkWorker.enqueue) — Record
+	// failures alone never drop an event.
+	Record(ctx context.Context, event SinkEvent) error
+}
+
+// NewRecorder builds a Recorder from a sink URI. Accepted schemes are
+// s3://, kafka:// and https-webhook://. Only s3:// and https-webhook://
+// deliver events; the kafka:// Recorder's Record always returns a
+// NotImplemented error, so its events are never delivered.
+func NewRecorder(uri string) (Recorder, error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	switch u.Scheme {
+	case "s3":
+		return newS3Recorder(u), nil
+	case "kafka":
+		return newKafkaRecorder(u), nil
+	case "https-webhook":
+		return newWebhookRecorder(u), nil
+	default:
+		return nil, trace.BadParameter("unsupported session sink scheme %q", u.Scheme)
+	}
+}
+
+// envAWSRegion, envAWSAccessKeyID, envAWSSecretAccessKey and
+// envAWSSessionToken name the standard AWS SDK environment variables this
+// sink reads credentials and region from, so it behaves like any other AWS
+// client without this package depending on one.
+const (
+	envAWSRegion          = "AWS_REGION"
+	envAWSAccessKeyID     = "AWS_ACCESS_KEY_ID"
+	envAWSSecretAccessKey = "AWS_SECRET_ACCESS_KEY"
+	envAWSSessionToken    = "AWS_SESSION_TOKEN"
+
+	defaultAWSRegion = "us-east-1"
+)
+
+// s3Recorder uploads each event as its own object, signed with SigV4 over
+// plain net/http. S3's REST API is simple enough to sign by hand, which
+// avoids pulling the AWS SDK into this package just for this one sink.
+type s3Recorder struct {
+	bucket   string
+	prefix   string
+	region   string
+	endpoint string // scheme://host, overridden by tests
+	client   *http.Client
+	now      func() time.Time
+}
+
+func newS3Recorder(u *url.URL) *s3Recorder {
+	region := os.Getenv(envAWSRegion)
+	if region == "" {
+		region = defaultAWSRegion
+	}
+	bucket := u.Host
+	return &s3Recorder{
+		bucket:   bucket,
+		prefix:   strings.TrimPrefix(u.Path, "/"),
+		region:   region,
+		endpoint: fmt.Sprintf("https://%s.s3.%s.amazonaws.com", bucket, region),
+		client:   &http.Client{Timeout: 10 * time.Second},
+		now:      time.Now,
+	}
+}
+
+func (s *s3Recorder) Name() string { return "s3:" + s.bucket }
+
+func (s *s3Recorder) Record(ctx context.Context, event SinkEvent) error {
+	accessKeyID := os.Getenv(envAWSAccessKeyID)
+	secretAccessKey := os.Getenv(envAWSSecretAccessKey)
+	if accessKeyID == "" || secretAccessKey == "" {
+		return trace.BadParameter("s3 session sink requires %s and %s to be set", envAWSAccessKeyID, envAWSSecretAccessKey)
+	}
+
+	body, err := json.Marshal(event)
+	if err != nil {
+		return trace.Wrap(err)
+	}
+
+	key := fmt.Sprintf("%s%s/%s-%d.json", s.prefix, event.Type, event.SessionID, s.now().UnixNano())
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, s.endpoint+"/"+key, bytes.NewReader(body))
+	if err != nil {
+		return trace.Wrap(err)
+	}
+
+	if err := s.sign(req, body, accessKeyID, secretAccessKey, os.Getenv(envAWSSessionToken)); err != nil {
+		return trace.Wrap(err)
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return trace.Wrap(err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return trace.BadParameter("s3 sink put to %s replied with status %d", req.URL, resp.StatusCode)
+	}
+	return nil
+}
+
+// sign adds SigV4 headers to req following the AWS "Authorization header"
+// signing process for a single-chunk payload.
+// See https://docs.aws.amazon.com/IAM/latest/UserGuide/create-signed-request.html
+func (s *s3Recorder) sign(req *http.Request, body []byte, accessKeyID, secretAccessKey, sessionToken string) error {
+	amzDate := s.now().UTC().Format("20060102T150405Z")
+	dateStamp := amzDate[:8]
+	payloadHash := hex.EncodeToString(sha256sum(body))
+
+	req.Header.Set("x-amz-date", amzDate)
+	req.Header.Set("x-amz-content-sha256", payloadHash)
+	req.Header.Set("host", req.URL.Host)
+	if sessionToken != "" {
+		req.Header.Set("x-amz-security-token", sessionToken)
+	}
+
+	signedHeaders := []string{"host", "x-amz-content-sha256", "x-amz-date"}
+	if sessionToken != "" {
+		signedHeaders = append(signedHeaders, "x-amz-security-token")
+	}
+
+	var canonicalHeaders strings.Builder
+	for _, h := range signedHeaders {
+		fmt.Fprintf(&canonicalHeaders, "%s:%s\n", h, req.Header.Get(h))
+	}
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		"",
+		canonicalHeaders.String(),
+		strings.Join(signedHeaders, ";"),
+		payloadHash,
+	}, "\n")
+
+	scope := fmt.Sprintf("%s/%s/s3/aws4_request", dateStamp, s.region)
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		amzDate,
+		scope,
+		hex.EncodeToString(sha256sum([]byte(canonicalRequest))),
+	}, "\n")
+
+	signingKey := hmacSHA256(hmacSHA256(hmacSHA256(hmacSHA256([]byte("AWS4"+secretAccessKey), dateStamp), s.region), "s3"), "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(signingKey, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf(
+		"AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		accessKeyID, scope, strings.Join(signedHeaders, ";"), signature,
+	))
+	return nil
+}
+
+func sha256sum(data []byte) []byte {
+	sum := sha256.Sum256(data)
+	return sum[:]
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+type kafkaRecorder struct {
+	brokers []string
+	topic   string
+}
+
+func newKafkaRecorder(u *url.URL) *kafkaRecorder {
+	topic := strings.TrimPrefix(u.Path, "/")
+	return &kafkaRecorder{brokers: strings.Split(u.Host, ","), topic: topic}
+}
+
+func (k *kafkaRecorder) Name() string { return "kafka:" + k.topic }
+
+func (k *kafkaRecorder) Record(ctx context.Context, event SinkEvent) error {
+	// s3Recorder above shows a sink can be hand-rolled over plain net/http
+	// when the wire protocol is a simple signed REST call; Kafka's isn't —
+	// producing requires API version negotiation and the record-batch
+	// binary format, which is enough surface area that hand-rolling it here
+	// would just be a worse reimplementation of an existing producer
+	// client. Use s3:// or https-webhook:// until this is wired to one.
+	return trace.NotImplemented("kafka session sink requires a producer client")
+}
+
+type webhookRecorder struct {
+	url    string
+	client *http.Client
+}
+
+func newWebhookRecorder(u *url.URL) *webhookRecorder {
+	// https-webhook://host/path maps onto https://host/path.
+	target := *u
+	target.Scheme = "https"
+	return &webhookRecorder{
+		url:    target.String(),
+		client: &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+func (w *webhookRecorder) Name() string { return "webhook:" + w.url }
+
+func (w *webhookRecorder) Record(ctx context.Context, event SinkEvent) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return trace.Wrap(err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.url, bytes.NewReader(body))
+	if err != nil {
+		return trace.Wrap(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return trace.Wrap(err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return trace.BadParameter("webhook sink %s replied with status %d", w.url, resp.StatusCode)
+	}
+	return nil
+}
+
+// sinkQueueSize bounds the number of events buffered per sink before new
+// events are dropped rather than applying backpressure to session writes.
+const sinkQueueSize = 1024
+
+var (
+	sinkDroppedTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "teleport_session_sink_dropped_total",
+		Help: "Number of session events dropped because a sink's queue was full",
+	}, []string{"sink"})
+	sinkLagSeconds = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "teleport_session_sink_lag_seconds",
+		Help: "Age of the oldest unacknowledged event in a sink's queue",
+	}, []string{"sink"})
+)
+
+func init() {
+	prometheus.MustRegister(sinkDroppedTotal, sinkLagSeconds)
+}
+
+// sinkWorker fans events out to a single Recorder through a bounded,
+// ordered ring buffer with retry/backoff, so that a slow or failing sink
+// never blocks the primary backend write path.
+type sinkWorker struct {
+	recorder Recorder
+	queue    chan queuedEvent
+	wg       sync.WaitGroup
+
+	mu      sync.Mutex
+	dropped uint64
+	oldest  time.Time
+}
+
+type queuedEvent struct {
+	event    SinkEvent
+	enqueued time.Time
+}
+
+func newSinkWorker(ctx context.Context, r Recorder) *sinkWorker {
+	w := &sinkWorker{
+		recorder: r,
+		queue:    make(chan queuedEvent, sinkQueueSize),
+	}
+	w.wg.Add(1)
+	go w.run(ctx)
+	return w
+}
+
+func (w *sinkWorker) enqueue(event SinkEvent) {
+	select {
+	case w.queue <- queuedEvent{event: event, enqueued: time.Now()}:
+	default:
+		w.mu.Lock()
+		w.dropped++
+		w.mu.Unlock()
+		sinkDroppedTotal.WithLabelValues(w.recorder.Name()).Inc()
+		log.WithField("sink", w.recorder.Name()).Warn("session sink queue full, dropping event")
+	}
+}
+
+// maxSinkRetryBackoff caps the exponential backoff between Record retries,
+// so a sink that's been down for a while is still retried at a sane rate
+// rather than ever-growing intervals.
+const maxSinkRetryBackoff = 30 * time.Second
+
+func (w *sinkWorker) run(ctx context.Context) {
+	defer w.wg.Done()
+	const initialBackoff = 100 * time.Millisecond
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case qe, ok := <-w.queue:
+			if !ok {
+				return
+			}
+			w.mu.Lock()
+			w.oldest = qe.enqueued
+			w.mu.Unlock()
+			sinkLagSeconds.WithLabelValues(w.recorder.Name()).Set(time.Since(qe.enqueued).Seconds())
+
+			// Retry until it succeeds or the worker is shutting down: once
+			// an event is in the queue, this is what makes delivery
+			// at-least-once rather than best-effort. The queue itself is
+			// the only place an event can still be lost (see enqueue).
+			delay := initialBackoff
+			for {
+				if err := w.recorder.Record(ctx, qe.event); err == nil {
+					break
+				} else {
+					log.WithError(err).WithField("sink", w.recorder.Name()).Warn("session sink event delivery failed, retrying")
+					select {
+					case <-ctx.Done():
+						return
+					case <-time.After(delay):
+					}
+					if delay *= 2; delay > maxSinkRetryBackoff {
+						delay = maxSinkRetryBackoff
+					}
+				}
+			}
+			w.mu.Lock()
+			w.oldest = time.Time{}
+			w.mu.Unlock()
+		}
+	}
+}
+
+func (w *sinkWorker) close() {
+	close(w.queue)
+	w.wg.Wait()
+}
+
+// SinkStatus summarizes the health of a single sink.
+type SinkStatus struct {
+	Dropped uint64
+	Lag     time.Duration
+}
+
+// SinkManager fans session lifecycle events out to every configured sink
+// asynchronously, so that a failing or slow sink can never block the
+// session server's writes to its primary backend.
+type SinkManager struct {
+	workers map[string]*sinkWorker
+}
+
+// NewSinkManager starts one worker per sink. The returned manager's Close
+// must be called to drain and stop the workers.
+func NewSinkManager(ctx context.Context, sinks []Recorder) *SinkManager {
+	m := &SinkManager{workers: make(map[string]*sinkWorker, len(sinks))}
+	for _, sink := range sinks {
+		m.workers[sink.Name()] = newSinkWorker(ctx, sink)
+	}
+	return m
+}
+
+// Fanout enqueues event on every sink's worker. It never blocks on sink
+// I/O: a full queue drops the event (and counts it) rather than applying
+// backpressure to the caller.
+func (m *SinkManager) Fanout(event SinkEvent) {
+	for _, w := range m.workers {
+		w.enqueue(event)
+	}
+}
+
+// SinkHealth reports the current drop count and lag for every sink.
+func (m *SinkManager) SinkHealth() map[string]SinkStatus {
+	out := make(map[string]SinkStatus, len(m.workers))
+	for name, w := range m.workers {
+		w.mu.Lock()
+		status := SinkStatus{Dropped: w.dropped}
+		if !w.oldest.IsZero() {
+			status.Lag = time.Since(w.oldest)
+		}
+		w.mu.Unlock()
+		out[name] = status
+	}
+	return out
+}
+
+// Close drains and stops every sink worker.
+func (m *SinkManager) Close() {
+	for _, w := range m.workers {
+		w.close()
+	}
+}
+
+// Config names the sinks session lifecycle events should be teed to.
+//
+// The session CRUD server that would hold a Config and call Fanout from
+// CreateSession/UpdateSession/DeleteSession/party-join/party-leave isn't
+// part of this tree (lib/session here has no session.go or backend.Backend
+// dependency to drive it against), so nothing calls NewSinkManagerFromConfig
+// yet; it's the wiring point a future session server constructor takes and
+// passes through, rather than Config being referenced only by its own type
+// declaration.
+type Config struct {
+	// Sinks lists the Recorders events are fanned out to.
+	Sinks []Recorder
+}
+
+// NewSinkManagerFromConfig starts one worker per sink in cfg.Sinks. See
+// NewSinkManager.
+func NewSinkManagerFromConfig(ctx context.Context, cfg Config) *SinkManager {
+	return NewSinkManager(ctx, cfg.Sinks)
+}
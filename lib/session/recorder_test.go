@@ -0,0 +1,268 @@
+/*
+Copyright 2021 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package session
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// fakeSink is an in-memory Recorder used to assert fan-out ordering and
+// failure isolation without standing up a real Kafka/S3/webhook endpoint.
+type fakeSink struct {
+	name string
+
+	mu       sync.Mutex
+	received []SinkEvent
+	fail     bool
+}
+
+func (f *fakeSink) Name() string { return f.name }
+
+func (f *fakeSink) Record(ctx context.Context, event SinkEvent) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.fail {
+		return context.DeadlineExceeded
+	}
+	f.received = append(f.received, event)
+	return nil
+}
+
+func (f *fakeSink) events() []SinkEvent {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	out := make([]SinkEvent, len(f.received))
+	copy(out, f.received)
+	return out
+}
+
+func TestWebhookRecorderDeliversEvent(t *testing.T) {
+	t.Parallel()
+
+	received := make(chan SinkEvent, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var event SinkEvent
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&event))
+		received <- event
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer srv.Close()
+
+	u, err := url.Parse("https-webhook://" + strings.TrimPrefix(srv.URL, "http://"))
+	require.NoError(t, err)
+	rec := newWebhookRecorder(u)
+	rec.url = srv.URL // the test server isn't actually TLS
+
+	err = rec.Record(context.Background(), SinkEvent{Type: EventSessionCreated, SessionID: "sess-1"})
+	require.NoError(t, err)
+
+	select {
+	case got := <-received:
+		require.Equal(t, EventSessionCreated, got.Type)
+		require.Equal(t, "sess-1", got.SessionID)
+	case <-time.After(time.Second):
+		t.Fatal("webhook server never received the event")
+	}
+}
+
+func TestWebhookRecorderErrorsOnNonSuccessStatus(t *testing.T) {
+	t.Parallel()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer srv.Close()
+
+	u, err := url.Parse("https-webhook://" + strings.TrimPrefix(srv.URL, "http://"))
+	require.NoError(t, err)
+	rec := newWebhookRecorder(u)
+	rec.url = srv.URL
+
+	err = rec.Record(context.Background(), SinkEvent{Type: EventSessionCreated, SessionID: "sess-1"})
+	require.Error(t, err)
+}
+
+func TestS3RecorderSignsAndDeliversEvent(t *testing.T) {
+	t.Setenv("AWS_ACCESS_KEY_ID", "AKIAEXAMPLE")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+	t.Setenv("AWS_REGION", "us-west-2")
+
+	var gotAuth, gotContentHash string
+	var gotEvent SinkEvent
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotAuth = r.Header.Get("Authorization")
+		gotContentHash = r.Header.Get("x-amz-content-sha256")
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&gotEvent))
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer srv.Close()
+
+	u, err := url.Parse("s3://my-bucket/recordings/")
+	require.NoError(t, err)
+	rec := newS3Recorder(u)
+	rec.endpoint = srv.URL
+
+	err = rec.Record(context.Background(), SinkEvent{Type: EventSessionCreated, SessionID: "sess-1"})
+	require.NoError(t, err)
+
+	require.Contains(t, gotAuth, "AWS4-HMAC-SHA256 Credential=AKIAEXAMPLE/")
+	require.Contains(t, gotAuth, "/us-west-2/s3/aws4_request")
+	require.NotEmpty(t, gotContentHash)
+	require.Equal(t, EventSessionCreated, gotEvent.Type)
+	require.Equal(t, "sess-1", gotEvent.SessionID)
+}
+
+func TestS3RecorderRequiresCredentials(t *testing.T) {
+	t.Setenv("AWS_ACCESS_KEY_ID", "")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "")
+
+	u, err := url.Parse("s3://my-bucket/recordings/")
+	require.NoError(t, err)
+	rec := newS3Recorder(u)
+
+	err = rec.Record(context.Background(), SinkEvent{Type: EventSessionCreated, SessionID: "sess-1"})
+	require.Error(t, err)
+}
+
+func TestSinkManagerFanoutOrdering(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	sink := &fakeSink{name: "memory"}
+	m := NewSinkManager(ctx, []Recorder{sink})
+	defer m.Close()
+
+	for i := 0; i < 5; i++ {
+		m.Fanout(SinkEvent{Type: EventSessionUpdated, SessionID: fmt.Sprintf("sess-%d", i)})
+	}
+
+	require.Eventually(t, func() bool {
+		return len(sink.events()) == 5
+	}, time.Second, 10*time.Millisecond)
+
+	got := sink.events()
+	for i, event := range got {
+		require.Equal(t, fmt.Sprintf("sess-%d", i), event.SessionID, "events must arrive in the order Fanout was called")
+	}
+}
+
+func TestSinkManagerRetriesFailingSinkUntilItRecovers(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	recovering := &fakeSink{name: "recovering", fail: true}
+	healthy := &fakeSink{name: "healthy"}
+	m := NewSinkManager(ctx, []Recorder{recovering, healthy})
+	defer m.Close()
+
+	m.Fanout(SinkEvent{Type: EventSessionCreated, SessionID: "sess-1"})
+
+	// The healthy sink isn't held up by the other sink's retries.
+	require.Eventually(t, func() bool {
+		return len(healthy.events()) == 1
+	}, time.Second, 10*time.Millisecond)
+
+	// The failing sink keeps retrying rather than dropping the event...
+	require.Never(t, func() bool {
+		return m.SinkHealth()["recovering"].Dropped > 0
+	}, 200*time.Millisecond, 20*time.Millisecond)
+
+	// ...and once it recovers, the retried event is finally delivered.
+	recovering.mu.Lock()
+	recovering.fail = false
+	recovering.mu.Unlock()
+
+	require.Eventually(t, func() bool {
+		return len(recovering.events()) == 1
+	}, time.Second, 10*time.Millisecond)
+	require.Zero(t, m.SinkHealth()["recovering"].Dropped)
+}
+
+func TestSinkManagerDropsEventsWhenQueueIsFull(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// A sink whose Record never returns stalls its worker forever, so
+	// everything past the first queued event has nowhere to go but the
+	// (bounded) queue, and then the drop path once that's full too.
+	blocked := make(chan struct{})
+	stalling := &blockingSink{name: "stalling", block: blocked}
+	m := NewSinkManager(ctx, []Recorder{stalling})
+	defer func() {
+		close(blocked)
+		m.Close()
+	}()
+
+	for i := 0; i < sinkQueueSize+10; i++ {
+		m.Fanout(SinkEvent{Type: EventSessionUpdated, SessionID: "sess-1"})
+	}
+
+	require.Eventually(t, func() bool {
+		return m.SinkHealth()["stalling"].Dropped > 0
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestNewSinkManagerFromConfig(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	sink := &fakeSink{name: "memory"}
+	m := NewSinkManagerFromConfig(ctx, Config{Sinks: []Recorder{sink}})
+	defer m.Close()
+
+	m.Fanout(SinkEvent{Type: EventSessionCreated, SessionID: "sess-1"})
+	require.Eventually(t, func() bool {
+		return len(sink.events()) == 1
+	}, time.Second, 10*time.Millisecond)
+}
+
+// blockingSink is a Recorder whose Record call hangs until block is closed,
+// used to force a sink's queue to fill up for TestSinkManagerDropsEventsWhenQueueIsFull.
+type blockingSink struct {
+	name  string
+	block <-chan struct{}
+}
+
+func (b *blockingSink) Name() string { return b.name }
+
+func (b *blockingSink) Record(ctx context.Context, event SinkEvent) error {
+	select {
+	case <-b.block:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}